@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+// adminDrain is set when drain mode was enabled through the API.
+var adminDrain atomic.Bool
+
+// serverIsDraining returns whether new sessions should be refused.
+func serverIsDraining() bool {
+	return config.Server.Drain.Enabled || adminDrain.Load() || serverShuttingDown.Load()
+}
+
+func restAdminDrainHandler(w http.ResponseWriter, r *http.Request) {
+	if !slices.Contains([]string{"GET", "PUT"}, r.Method) {
+		http.Error(w, "Not implemented", 501)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// Validate API key.
+	requestKey := r.URL.Query().Get("key")
+	bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if ok {
+		requestKey = bearer
+	}
+
+	if !slices.Contains(config.Server.Admin.Keys, requestKey) {
+		http.Error(w, "Invalid authentication key", 401)
+		return
+	}
+
+	// Update the drain state.
+	if r.Method == "PUT" {
+		req := struct {
+			Enabled bool `json:"enabled"`
+		}{}
+
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, "Invalid request", 400)
+			return
+		}
+
+		adminDrain.Store(req.Enabled)
+		logRequestLogger(r).Info("Updated drain mode", "enabled", req.Enabled)
+	}
+
+	// Get some instance data.
+	instanceCount, err := dbActiveCount()
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	body := make(map[string]interface{})
+	body["enabled"] = adminDrain.Load()
+	body["config"] = config.Server.Drain.Enabled
+	body["draining"] = serverIsDraining()
+	body["instance_count"] = instanceCount
+
+	err = json.NewEncoder(w).Encode(body)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+}
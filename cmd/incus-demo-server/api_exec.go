@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lxc/incus/v6/shared/api"
+)
+
+// Global variables.
+var (
+	execLimitersLock sync.Mutex
+	execLimiters     = map[string]*rateLimiter{}
+	execRunning      = map[string]int{}
+)
+
+type execRequest struct {
+	Command     []string          `json:"command"`
+	Environment map[string]string `json:"environment"`
+	Stdin       string            `json:"stdin"`
+	Timeout     int               `json:"timeout"`
+}
+
+func restExecHandler(w http.ResponseWriter, r *http.Request) {
+	if !config.Session.Exec.Enabled {
+		http.Error(w, "Command execution is disabled", 400)
+		return
+	}
+
+	if r.Method == "OPTIONS" {
+		origin := r.Header.Get("Origin")
+		if origin != "" {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		}
+
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "Not implemented", 501)
+		return
+	}
+
+	if maintenanceEnabled() || incusDaemon == nil {
+		http.Error(w, "Server in maintenance mode", 500)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	// Get the id argument.
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "Missing session id", 400)
+		return
+	}
+
+	// Get the instance.
+	sessionId, instanceName, _, _, _, _, err := dbGetInstance(id, true)
+	if err != nil || sessionId == -1 {
+		http.Error(w, "Session not found", 404)
+		return
+	}
+
+	// Check the rate limit.
+	if !execLimiter(id).allow(1) {
+		http.Error(w, "Too many requests", 429)
+		return
+	}
+
+	// Check the number of running commands.
+	if !execAcquire(id) {
+		http.Error(w, "Too many commands running", 429)
+		return
+	}
+
+	defer execRelease(id)
+
+	// Parse request.
+	req := execRequest{}
+
+	err = json.NewDecoder(http.MaxBytesReader(w, r.Body, config.Session.Exec.MaxInput)).Decode(&req)
+	if err != nil {
+		http.Error(w, "Invalid JSON data", 400)
+		return
+	}
+
+	if len(req.Command) == 0 {
+		http.Error(w, "Missing command", 400)
+		return
+	}
+
+	timeout := config.Session.Exec.Timeout
+	if req.Timeout > 0 && req.Timeout < timeout {
+		timeout = req.Timeout
+	}
+
+	// Resume the instance if it was frozen.
+	err = sessionUnfreeze(sessionId, id, instanceName)
+	if err != nil {
+		logRequestLogger(r).Error("Failed to unfreeze the session", logSession, id, logInstance, instanceName, logError, err)
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	activityRecord(id, int64(len(req.Stdin)), 0)
+
+	// Run the command.
+	env := map[string]string{
+		"USER": "root",
+		"HOME": "/root",
+	}
+
+	for k, v := range req.Environment {
+		env[k] = v
+	}
+
+	execReq := api.InstanceExecPost{
+		Command:     req.Command,
+		Environment: env,
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	var stdoutBuf bytes.Buffer
+	var stderrBuf bytes.Buffer
+	stdout := &limitWriter{Writer: &stdoutBuf, limit: config.Session.Exec.MaxOutput}
+	stderr := &limitWriter{Writer: &stderrBuf, limit: config.Session.Exec.MaxOutput}
+
+	exitCode, err := incusExecContext(ctx, incusDaemon, instanceName, execReq, strings.NewReader(req.Stdin), stdout, stderr)
+	if err != nil {
+		logRequestLogger(r).Error("Failed to run the command", logSession, id, logInstance, instanceName, logError, err)
+		http.Error(w, "Unable to run the command", 500)
+		return
+	}
+
+	activityRecord(id, 0, stdout.size+stderr.size)
+
+	body := make(map[string]interface{})
+	body["stdout"] = stdoutBuf.String()
+	body["stderr"] = stderrBuf.String()
+	body["exit_code"] = exitCode
+	body["truncated"] = stdout.exceeded || stderr.exceeded
+	body["timed_out"] = ctx.Err() == context.DeadlineExceeded
+
+	err = json.NewEncoder(w).Encode(body)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+}
+
+// execLimiter returns the exec rate limiter for the session.
+func execLimiter(id string) *rateLimiter {
+	execLimitersLock.Lock()
+	defer execLimitersLock.Unlock()
+
+	limiter, ok := execLimiters[id]
+	if !ok {
+		limiter = newRateLimiter(config.Session.Exec.Rate)
+		execLimiters[id] = limiter
+	}
+
+	return limiter
+}
+
+// execAcquire reserves a slot for a command in the session, returning false if too many are running.
+func execAcquire(id string) bool {
+	execLimitersLock.Lock()
+	defer execLimitersLock.Unlock()
+
+	if execRunning[id] >= config.Session.Exec.Concurrency {
+		return false
+	}
+
+	execRunning[id]++
+
+	return true
+}
+
+func execRelease(id string) {
+	execLimitersLock.Lock()
+	defer execLimitersLock.Unlock()
+
+	execRunning[id]--
+	if execRunning[id] <= 0 {
+		delete(execRunning, id)
+	}
+}
+
+// execForget releases the exec rate limiter of an ended session.
+func execForget(id string) {
+	execLimitersLock.Lock()
+	defer execLimitersLock.Unlock()
+
+	delete(execLimiters, id)
+	delete(execRunning, id)
+}
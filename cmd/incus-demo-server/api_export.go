@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/lxc/incus/v6/shared/api"
+	"github.com/pborman/uuid"
+)
+
+var (
+	errExportTooLarge = errors.New("Export is larger than the allowed size")
+	errExportRunning  = errors.New("An export is already running")
+	errExportTimedOut = errors.New("Export took too long")
+)
+
+// Global variables.
+var (
+	exportsRunningLock sync.Mutex
+	exportsRunning     = map[int64]bool{}
+)
+
+func restExportHandler(w http.ResponseWriter, r *http.Request) {
+	if len(config.Session.Export.Paths) == 0 {
+		http.Error(w, "Session exports are disabled", 400)
+		return
+	}
+
+	if r.Method == "OPTIONS" {
+		origin := r.Header.Get("Origin")
+		if origin != "" {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		}
+
+		return
+	}
+
+	if !slices.Contains([]string{"GET", "POST", "PUT"}, r.Method) {
+		http.Error(w, "Not implemented", 501)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if r.Method == "GET" {
+		restExportGetHandler(w, r)
+		return
+	}
+
+	if maintenanceEnabled() || incusDaemon == nil {
+		http.Error(w, "Server in maintenance mode", 500)
+		return
+	}
+
+	// Get the id argument.
+	id := r.FormValue("id")
+	if id == "" {
+		http.Error(w, "Missing session id", 400)
+		return
+	}
+
+	// Get the instance.
+	sessionId, instanceName, _, _, _, _, err := dbGetInstance(id, true)
+	if err != nil || sessionId == -1 {
+		http.Error(w, "Session not found", 404)
+		return
+	}
+
+	if r.Method == "PUT" {
+		restExportPutHandler(w, r, sessionId)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// Generate the archive.
+	token, size, expiry, err := exportCreate(sessionId, id, instanceName)
+	if err != nil {
+		if errors.Is(err, errExportTooLarge) {
+			http.Error(w, "Export size limit reached", 413)
+			return
+		}
+
+		if errors.Is(err, errExportRunning) {
+			http.Error(w, "An export is already running", 409)
+			return
+		}
+
+		if errors.Is(err, errExportTimedOut) {
+			http.Error(w, "Export took too long", 504)
+			return
+		}
+
+		logRequestLogger(r).Error("Failed to export the session", logSession, id, logInstance, instanceName, logError, err)
+		http.Error(w, "Unable to export the session", 500)
+		return
+	}
+
+	body := make(map[string]interface{})
+	body["url"] = exportLink(token)
+	body["size"] = size
+	body["expiry"] = expiry
+
+	err = json.NewEncoder(w).Encode(body)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+}
+
+func restExportGetHandler(w http.ResponseWriter, r *http.Request) {
+	// Get the token argument.
+	token := r.FormValue("token")
+	if uuid.Parse(token) == nil {
+		http.Error(w, "Invalid export token", 400)
+		return
+	}
+
+	sessionId, expiry, err := dbGetExport(token)
+	if err != nil || sessionId == -1 || expiry < time.Now().Unix() {
+		http.Error(w, "Export not found", 404)
+		return
+	}
+
+	f, err := os.Open(exportArchivePath(token))
+	if err != nil {
+		http.Error(w, "Export not found", 404)
+		return
+	}
+
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", `attachment; filename="incus-demo-export.tar.gz"`)
+	http.ServeContent(w, r, "incus-demo-export.tar.gz", fi.ModTime(), f)
+}
+
+func restExportPutHandler(w http.ResponseWriter, r *http.Request, sessionId int64) {
+	if config.Server.Feedback.Email.Server == "" || config.Session.Export.URL == "" {
+		http.Error(w, "E-mail delivery isn't configured", 400)
+		return
+	}
+
+	// Parse request.
+	req := struct {
+		Email string `json:"email"`
+	}{}
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "Invalid JSON data", 400)
+		return
+	}
+
+	// An empty address opts out again.
+	if req.Email != "" {
+		addr, err := mail.ParseAddress(req.Email)
+		if err != nil {
+			http.Error(w, "Invalid e-mail address", 400)
+			return
+		}
+
+		req.Email = addr.Address
+	}
+
+	err = dbSetExportEmail(sessionId, req.Email)
+	if err != nil {
+		http.Error(w, "Unable to record the e-mail address", 500)
+		return
+	}
+}
+
+// exportCreate archives the configured paths of the instance, replacing any previous export of the session and returning the token, size and expiry of the download.
+func exportCreate(sessionID int64, sessionUUID string, instanceName string) (string, int64, int64, error) {
+	// Only run one export at a time per session.
+	exportsRunningLock.Lock()
+	if exportsRunning[sessionID] {
+		exportsRunningLock.Unlock()
+		return "", 0, 0, errExportRunning
+	}
+
+	exportsRunning[sessionID] = true
+	exportsRunningLock.Unlock()
+
+	defer func() {
+		exportsRunningLock.Lock()
+		delete(exportsRunning, sessionID)
+		exportsRunningLock.Unlock()
+	}()
+
+	// The instance can't run anything while frozen.
+	err := sessionUnfreeze(sessionID, sessionUUID, instanceName)
+	if err != nil {
+		return "", 0, 0, err
+	}
+
+	err = os.MkdirAll(config.Session.Export.Path, 0700)
+	if err != nil {
+		return "", 0, 0, err
+	}
+
+	token := uuid.NewRandom().String()
+	archivePath := exportArchivePath(token)
+
+	f, err := os.OpenFile(archivePath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", 0, 0, err
+	}
+
+	defer f.Close()
+
+	// Stream the archive out of the instance.
+	paths := []string{}
+	for _, entry := range config.Session.Export.Paths {
+		paths = append(paths, strings.TrimPrefix(entry, "/"))
+	}
+
+	req := api.InstanceExecPost{
+		Command: append([]string{"tar", "-czf", "-", "-C", "/"}, paths...),
+	}
+
+	// Kill the archive command once it's too slow or too large.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.Session.Export.Timeout)*time.Second)
+	defer cancel()
+
+	stdout := &limitWriter{Writer: f, limit: config.Session.Export.MaxSize, onExceeded: cancel}
+	exitCode, err := incusExecContext(ctx, incusDaemon, instanceName, req, nil, stdout, io.Discard)
+	if stdout.exceeded {
+		err = errExportTooLarge
+	} else if ctx.Err() == context.DeadlineExceeded {
+		err = errExportTimedOut
+	} else if err == nil && stdout.size == 0 {
+		err = fmt.Errorf("Archive command failed with exit code %d", exitCode)
+	}
+
+	if err != nil {
+		_ = os.Remove(archivePath)
+		return "", 0, 0, err
+	}
+
+	// Missing paths make tar fail but the archive is still usable.
+	if exitCode != 0 {
+		slog.Warn("Archive command reported errors", logSession, sessionUUID, logInstance, instanceName, "exit_code", exitCode)
+	}
+
+	previous, err := dbGetSessionExports(sessionID)
+	if err != nil {
+		_ = os.Remove(archivePath)
+		return "", 0, 0, err
+	}
+
+	expiry := time.Now().Unix() + int64(config.Session.Export.Expiry)
+	err = dbNewExport(sessionID, token, stdout.size, expiry)
+	if err != nil {
+		_ = os.Remove(archivePath)
+		return "", 0, 0, err
+	}
+
+	// Only keep the latest export of the session.
+	for _, entry := range previous {
+		err := exportDelete(entry[0].(string))
+		if err != nil {
+			slog.Error("Failed to delete the previous export", logSession, sessionUUID, logError, err)
+		}
+	}
+
+	slog.Info("Session exported", logSession, sessionUUID, logInstance, instanceName, "size", stdout.size)
+
+	return token, stdout.size, expiry, nil
+}
+
+// exportSessionEmail returns the address to send the export to if the user opted in to have the session exported when it ends.
+func exportSessionEmail(sessionID int64) string {
+	if len(config.Session.Export.Paths) == 0 || config.Server.Feedback.Email.Server == "" || config.Session.Export.URL == "" {
+		return ""
+	}
+
+	email, err := dbGetExportEmail(sessionID)
+	if err != nil {
+		return ""
+	}
+
+	return email
+}
+
+// exportSessionEnd exports the session and e-mails the link, it must run before the instance is deleted.
+func exportSessionEnd(sessionID int64, sessionUUID string, instanceName string, email string) {
+	token, _, expiry, err := exportCreate(sessionID, sessionUUID, instanceName)
+	if err != nil {
+		slog.Error("Failed to export the session", logSession, sessionUUID, logInstance, instanceName, logError, err)
+		return
+	}
+
+	go emailExport(email, token, expiry)
+}
+
+var exportEmailTpl = template.Must(template.New("exportEmailTpl").Parse(`From: {{ .from }}
+To: {{ .to }}
+Subject: Your session export
+
+Your try-it session has ended, the content of your instance can be downloaded from:
+{{ .url }}
+
+This link expires on {{ .expiry }}.
+`))
+
+func emailExport(email string, token string, expiry int64) {
+	data := map[string]any{
+		"from":   config.Server.Feedback.Email.From,
+		"to":     email,
+		"url":    strings.TrimSuffix(config.Session.Export.URL, "/") + exportLink(token),
+		"expiry": time.Unix(expiry, 0).UTC().Format(time.RFC1123),
+	}
+
+	var sb *strings.Builder = &strings.Builder{}
+	err := exportEmailTpl.Execute(sb, data)
+	if err != nil {
+		slog.Error("Failed to render the export email", logError, err)
+		return
+	}
+
+	err = smtp.SendMail(config.Server.Feedback.Email.Server, nil, config.Server.Feedback.Email.From, []string{email}, []byte(sb.String()))
+	if err != nil {
+		slog.Error("Failed to send the export email", logError, err)
+		return
+	}
+}
+
+// exportMonitor removes the archives whose download link has expired.
+func exportMonitor() {
+	for {
+		time.Sleep(10 * time.Minute)
+
+		if len(config.Session.Export.Paths) == 0 {
+			continue
+		}
+
+		exports, err := dbGetExpiredExports()
+		if err != nil {
+			slog.Error("Unable to read expired exports", logError, err)
+			continue
+		}
+
+		for _, entry := range exports {
+			token := entry[0].(string)
+
+			err := exportDelete(token)
+			if err != nil {
+				slog.Error("Failed to delete the expired export", "token", token, logError, err)
+			}
+		}
+	}
+}
+
+// exportDelete removes the archive and record of an export.
+func exportDelete(token string) error {
+	err := os.Remove(exportArchivePath(token))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return dbDeleteExport(token)
+}
+
+func exportArchivePath(token string) string {
+	return filepath.Join(config.Session.Export.Path, token+".tar.gz")
+}
+
+func exportLink(token string) string {
+	return fmt.Sprintf("/1.0/export?token=%s", token)
+}
@@ -2,7 +2,7 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
+	"log/slog"
 	"net/http"
 	"net/smtp"
 	"strings"
@@ -129,13 +129,13 @@ func emailFeedback(feedback Feedback) {
 	var sb *strings.Builder = &strings.Builder{}
 	err := emailTpl.Execute(sb, data)
 	if err != nil {
-		fmt.Printf("error: %s\n", err)
+		slog.Error("Failed to render the feedback email", logError, err)
 		return
 	}
 
 	err = smtp.SendMail(config.Server.Feedback.Email.Server, nil, config.Server.Feedback.Email.From, []string{config.Server.Feedback.Email.To}, []byte(sb.String()))
 	if err != nil {
-		fmt.Printf("error: %s\n", err)
+		slog.Error("Failed to send the feedback email", logError, err)
 		return
 	}
 }
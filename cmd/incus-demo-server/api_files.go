@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/lxc/incus/v6/client"
+)
+
+func restFilesHandler(w http.ResponseWriter, r *http.Request) {
+	if len(config.Session.Files.Paths) == 0 {
+		http.Error(w, "File transfers are disabled", 400)
+		return
+	}
+
+	if maintenanceEnabled() || incusDaemon == nil {
+		http.Error(w, "Server in maintenance mode", 500)
+		return
+	}
+
+	if r.Method == "OPTIONS" {
+		origin := r.Header.Get("Origin")
+		if origin != "" {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, PUT, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		}
+
+		return
+	}
+
+	if !slices.Contains([]string{"GET", "PUT", "DELETE"}, r.Method) {
+		http.Error(w, "Not implemented", 501)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	// Get the id argument.
+	id := r.FormValue("id")
+	if id == "" {
+		http.Error(w, "Missing session id", 400)
+		return
+	}
+
+	// Get the path argument.
+	filePath, err := filesValidatePath(r.FormValue("path"))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	// Get the instance.
+	sessionId, instanceName, _, _, _, _, err := dbGetInstance(id, true)
+	if err != nil || sessionId == -1 {
+		http.Error(w, "Session not found", 404)
+		return
+	}
+
+	// File transfers hang on a frozen instance.
+	err = sessionUnfreeze(sessionId, id, instanceName)
+	if err != nil {
+		logRequestLogger(r).Error("Failed to unfreeze the session", logSession, id, logInstance, instanceName, logError, err)
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	if r.Method == "GET" {
+		restFilesGetHandler(w, r, instanceName, filePath)
+		return
+	}
+
+	if r.Method == "PUT" {
+		restFilesPutHandler(w, r, sessionId, instanceName, filePath)
+		return
+	}
+
+	restFilesDeleteHandler(w, r, instanceName, filePath)
+}
+
+// filesValidatePath cleans up the requested path and checks that it's within one of the allowed directories.
+func filesValidatePath(requestPath string) (string, error) {
+	if requestPath == "" {
+		return "", fmt.Errorf("Missing path")
+	}
+
+	if !path.IsAbs(requestPath) {
+		return "", fmt.Errorf("Path must be absolute")
+	}
+
+	filePath := path.Clean(requestPath)
+	for _, allowed := range config.Session.Files.Paths {
+		allowed = path.Clean(allowed)
+		if filePath == allowed || strings.HasPrefix(filePath, allowed+"/") {
+			return filePath, nil
+		}
+	}
+
+	return "", fmt.Errorf("Path isn't allowed")
+}
+
+func restFilesGetHandler(w http.ResponseWriter, r *http.Request, instanceName string, filePath string) {
+	content, resp, err := incusDaemon.GetInstanceFile(instanceName, filePath)
+	if err != nil {
+		http.Error(w, "File not found", 404)
+		return
+	}
+
+	if content != nil {
+		defer content.Close()
+	}
+
+	// Directory listing.
+	if resp.Type == "directory" {
+		w.Header().Set("Content-Type", "application/json")
+
+		body := make(map[string]interface{})
+		body["type"] = resp.Type
+		body["mode"] = resp.Mode
+		body["entries"] = resp.Entries
+
+		err = json.NewEncoder(w).Encode(body)
+		if err != nil {
+			http.Error(w, "Internal server error", 500)
+			return
+		}
+
+		return
+	}
+
+	// File download.
+	reader := io.Reader(content)
+	if config.Session.Files.MaxSize > 0 {
+		// The file size isn't known upfront, so read up to the limit before sending anything.
+		data, err := io.ReadAll(io.LimitReader(content, config.Session.Files.MaxSize+1))
+		if err != nil {
+			http.Error(w, "Internal server error", 500)
+			return
+		}
+
+		if int64(len(data)) > config.Session.Files.MaxSize {
+			http.Error(w, "File is too large", 413)
+			return
+		}
+
+		reader = bytes.NewReader(data)
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(filePath)))
+
+	_, err = io.Copy(w, reader)
+	if err != nil {
+		return
+	}
+}
+
+func restFilesPutHandler(w http.ResponseWriter, r *http.Request, sessionId int64, instanceName string, filePath string) {
+	args := incus.InstanceFileArgs{
+		Type:      "file",
+		Mode:      0644,
+		WriteMode: "overwrite",
+	}
+
+	// Directory creation.
+	if r.FormValue("type") == "directory" {
+		args.Type = "directory"
+		args.Mode = 0755
+
+		err := incusDaemon.CreateInstanceFile(instanceName, filePath, args)
+		if err != nil {
+			http.Error(w, "Unable to create the directory", 500)
+			return
+		}
+
+		return
+	}
+
+	// Spool the content to disk (with size limit) as the upload needs a seekable reader.
+	reader := io.Reader(r.Body)
+	if config.Session.Files.MaxSize > 0 {
+		reader = http.MaxBytesReader(w, r.Body, config.Session.Files.MaxSize)
+	}
+
+	spool, err := os.CreateTemp("", "incus-demo-upload-")
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	defer func() {
+		_ = spool.Close()
+		_ = os.Remove(spool.Name())
+	}()
+
+	size, err := io.Copy(spool, reader)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, "File is too large", 413)
+			return
+		}
+
+		http.Error(w, "Unable to read the file", 400)
+		return
+	}
+
+	// Check the session quota.
+	if config.Session.Files.Quota > 0 {
+		uploaded, err := dbGetFilesUploaded(sessionId)
+		if err != nil {
+			http.Error(w, "Internal server error", 500)
+			return
+		}
+
+		if uploaded+size > config.Session.Files.Quota {
+			http.Error(w, "Session upload quota has been reached", 413)
+			return
+		}
+	}
+
+	// Upload the file.
+	_, err = spool.Seek(0, io.SeekStart)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	args.Content = spool
+
+	err = incusDaemon.CreateInstanceFile(instanceName, filePath, args)
+	if err != nil {
+		http.Error(w, "Unable to upload the file", 500)
+		return
+	}
+
+	err = dbAddFilesUploaded(sessionId, size)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+}
+
+func restFilesDeleteHandler(w http.ResponseWriter, r *http.Request, instanceName string, filePath string) {
+	// Don't allow removing the allowed directories themselves.
+	for _, allowed := range config.Session.Files.Paths {
+		if filePath == path.Clean(allowed) {
+			http.Error(w, "Path can't be deleted", 400)
+			return
+		}
+	}
+
+	err := incusDaemon.DeleteInstanceFile(instanceName, filePath)
+	if err != nil {
+		http.Error(w, "Unable to delete the file", 500)
+		return
+	}
+}
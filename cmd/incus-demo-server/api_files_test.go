@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestFilesValidatePath(t *testing.T) {
+	previous := config
+	t.Cleanup(func() { config = previous })
+
+	config.Session.Files.Paths = []string{"/root", "/home/admin/"}
+
+	tests := []struct {
+		name    string
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{name: "allowed directory", path: "/root", want: "/root"},
+		{name: "allowed file", path: "/root/notes.txt", want: "/root/notes.txt"},
+		{name: "nested file", path: "/home/admin/src/main.go", want: "/home/admin/src/main.go"},
+		{name: "trailing slash", path: "/root/", want: "/root"},
+		{name: "cleaned up", path: "/root/./a//b/../c", want: "/root/a/c"},
+		{name: "missing", path: "", wantErr: true},
+		{name: "relative", path: "root/notes.txt", wantErr: true},
+		{name: "outside", path: "/etc/passwd", wantErr: true},
+		{name: "traversal", path: "/root/../etc/passwd", wantErr: true},
+		{name: "shared prefix", path: "/rootfs/file", wantErr: true},
+		{name: "parent of allowed", path: "/home", wantErr: true},
+		{name: "filesystem root", path: "/", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := filesValidatePath(tt.path)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("filesValidatePath(%q) = %q, expected an error", tt.path, got)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("filesValidatePath(%q) failed: %v", tt.path, err)
+			}
+
+			if got != tt.want {
+				t.Fatalf("filesValidatePath(%q) = %q, expected %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// healthCheck is the result of a single readiness check.
+type healthCheck struct {
+	OK      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+}
+
+func restHealthzHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Not implemented", 501)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	body := make(map[string]interface{})
+	body["status"] = "ok"
+
+	err := json.NewEncoder(w).Encode(body)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+}
+
+func restReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Not implemented", 501)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	checks := map[string]healthCheck{}
+
+	// Incus connectivity.
+	if incusDaemon == nil {
+		checks["incus"] = healthCheck{Message: "Not connected to Incus"}
+	} else {
+		_, _, err := incusDaemon.GetServer()
+		if err != nil {
+			checks["incus"] = healthCheck{Message: err.Error()}
+		} else {
+			checks["incus"] = healthCheck{OK: true}
+		}
+	}
+
+	// Database.
+	err := dbCheckWritable()
+	if err != nil {
+		checks["database"] = healthCheck{Message: err.Error()}
+	} else {
+		checks["database"] = healthCheck{OK: true}
+	}
+
+	// Pool of pre-allocated instances.
+	allocated, err := dbAllocated()
+	if err != nil {
+		checks["pool"] = healthCheck{Message: err.Error()}
+	} else if config.Instance.Allocate.Count > 0 && len(allocated)*2 < config.Instance.Allocate.Count {
+		// Degrade once the pool is less than half full.
+		checks["pool"] = healthCheck{Message: fmt.Sprintf("Pool is below half of its target (%d/%d instances)", len(allocated), config.Instance.Allocate.Count)}
+	} else {
+		checks["pool"] = healthCheck{OK: true, Message: fmt.Sprintf("%d/%d instances", len(allocated), config.Instance.Allocate.Count)}
+	}
+
+	// Incus proxy.
+	if config.Server.Proxy.Address != "" {
+		if proxyListening.Load() {
+			checks["proxy"] = healthCheck{OK: true}
+		} else {
+			checks["proxy"] = healthCheck{Message: "Proxy isn't listening"}
+		}
+	}
+
+	// Drain mode.
+	if serverIsDraining() {
+		checks["drain"] = healthCheck{Message: "Server is draining"}
+	} else {
+		checks["drain"] = healthCheck{OK: true}
+	}
+
+	// Generate the response.
+	ready := true
+	for _, check := range checks {
+		if !check.OK {
+			ready = false
+		}
+	}
+
+	body := make(map[string]interface{})
+	body["checks"] = checks
+
+	if ready {
+		body["status"] = "ok"
+	} else {
+		body["status"] = "failed"
+		w.WriteHeader(503)
+	}
+
+	err = json.NewEncoder(w).Encode(body)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+
+	"github.com/pborman/uuid"
+)
+
+const (
+	inviteShared   = "shared"
+	inviteSeparate = "separate"
+)
+
+func restInviteHandler(w http.ResponseWriter, r *http.Request) {
+	if maintenanceEnabled() || incusDaemon == nil {
+		http.Error(w, "Server in maintenance mode", 500)
+		return
+	}
+
+	if r.Method == "POST" {
+		restInvitePostHandler(w, r)
+		return
+	}
+
+	if r.Method == "GET" {
+		restInviteGetHandler(w, r)
+		return
+	}
+
+	if r.Method == "DELETE" {
+		restInviteDeleteHandler(w, r)
+		return
+	}
+
+	if r.Method == "OPTIONS" {
+		origin := r.Header.Get("Origin")
+		if origin != "" {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		}
+
+		return
+	}
+
+	http.Error(w, "Not implemented", 501)
+}
+
+func restInvitePostHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	// Get the id argument.
+	id := r.FormValue("id")
+	if id == "" {
+		http.Error(w, "Missing session id", 400)
+		return
+	}
+
+	// Get the mode argument.
+	mode := r.FormValue("mode")
+	if mode == "" {
+		mode = inviteShared
+	}
+
+	if !slices.Contains([]string{inviteShared, inviteSeparate}, mode) {
+		http.Error(w, "Invalid invite mode", 400)
+		return
+	}
+
+	// Get the instance.
+	sessionId, _, _, _, _, _, err := dbGetInstance(id, true)
+	if err != nil || sessionId == -1 {
+		http.Error(w, "Session not found", 404)
+		return
+	}
+
+	// Create the invite.
+	token := uuid.NewRandom().String()
+
+	_, err = dbNewInvite(sessionId, token, mode)
+	if err != nil {
+		http.Error(w, "Unable to create the invite", 500)
+		return
+	}
+
+	// Return to the client.
+	body := make(map[string]interface{})
+	body["token"] = token
+	body["mode"] = mode
+
+	err = json.NewEncoder(w).Encode(body)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+}
+
+func restInviteGetHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	// Get the id argument.
+	id := r.FormValue("id")
+	if id == "" {
+		http.Error(w, "Missing session id", 400)
+		return
+	}
+
+	// Get the instance.
+	sessionId, _, _, _, _, _, err := dbGetInstance(id, false)
+	if err != nil || sessionId == -1 {
+		http.Error(w, "Session not found", 404)
+		return
+	}
+
+	// Get the invites.
+	invites, err := dbGetInvites(sessionId)
+	if err != nil {
+		http.Error(w, "Unable to retrieve the invites", 500)
+		return
+	}
+
+	// Generate the response.
+	body := []map[string]interface{}{}
+	for _, entry := range invites {
+		inviteID := int64(entry[0].(int))
+
+		guests, err := dbGetGuests(inviteID)
+		if err != nil {
+			http.Error(w, "Unable to retrieve the invites", 500)
+			return
+		}
+
+		guestsBody := []map[string]interface{}{}
+		for _, guest := range guests {
+			guestsBody = append(guestsBody, map[string]interface{}{
+				"date": guest[0].(int),
+				"ip":   guest[1].(string),
+			})
+		}
+
+		body = append(body, map[string]interface{}{
+			"token":   entry[1].(string),
+			"mode":    entry[2].(string),
+			"date":    entry[3].(int),
+			"revoked": entry[4].(int) == 1,
+			"guests":  guestsBody,
+		})
+	}
+
+	// Return to the client.
+	err = json.NewEncoder(w).Encode(body)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+}
+
+func restInviteDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	// Get the id and token arguments.
+	id := r.FormValue("id")
+	if id == "" {
+		http.Error(w, "Missing session id", 400)
+		return
+	}
+
+	token := r.FormValue("token")
+	if token == "" {
+		http.Error(w, "Missing invite token", 400)
+		return
+	}
+
+	// Get the instance.
+	sessionId, _, _, _, _, _, err := dbGetInstance(id, false)
+	if err != nil || sessionId == -1 {
+		http.Error(w, "Session not found", 404)
+		return
+	}
+
+	// Revoke the invite.
+	inviteID, err := dbRevokeInvite(sessionId, token)
+	if err != nil {
+		http.Error(w, "Invite not found", 404)
+		return
+	}
+
+	// Disconnect any guest using it.
+	consoleDisconnectInvite(id, inviteID)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/lxc/incus/v6/client"
+	"github.com/lxc/incus/v6/shared/api"
+	incusTls "github.com/lxc/incus/v6/shared/tls"
+	"github.com/pborman/uuid"
+)
+
+const (
+	remoteBundle = "bundle"
+	remoteToken  = "token"
+)
+
+func restRemoteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Not implemented", 501)
+		return
+	}
+
+	if config.Server.Proxy.Address == "" {
+		http.Error(w, "The Incus proxy is disabled", 400)
+		return
+	}
+
+	if maintenanceEnabled() || incusDaemon == nil {
+		http.Error(w, "Server in maintenance mode", 500)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	// Get the id argument.
+	id := r.FormValue("id")
+	if id == "" {
+		http.Error(w, "Missing session id", 400)
+		return
+	}
+
+	// Get the type argument.
+	remoteType := r.FormValue("type")
+	if remoteType == "" {
+		remoteType = remoteBundle
+	}
+
+	// Bundles rely on the proxy terminating TLS, tokens on it passing TLS through.
+	var mapping *proxyMapping
+	switch remoteType {
+	case remoteBundle:
+		mapping = remoteGetMapping(proxyTLSTerminate)
+	case remoteToken:
+		mapping = remoteGetMapping(proxyTLSPassthrough)
+	default:
+		http.Error(w, "Invalid remote type", 400)
+		return
+	}
+
+	if mapping == nil {
+		http.Error(w, "No suitable Incus proxy mapping configured", 400)
+		return
+	}
+
+	// Get the instance.
+	sessionId, instanceName, _, _, _, _, err := dbGetInstance(id, true)
+	if err != nil || sessionId == -1 {
+		http.Error(w, "Session not found", 404)
+		return
+	}
+
+	// Figure out the address of the remote.
+	_, port, err := net.SplitHostPort(config.Server.Proxy.Address)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	address := net.JoinHostPort(strings.Replace(mapping.Name, "{uuid}", id, 1), port)
+
+	// Resume the instance if it was frozen.
+	err = sessionUnfreeze(sessionId, id, instanceName)
+	if err != nil {
+		logRequestLogger(r).Error("Failed to unfreeze the session", logSession, id, logInstance, instanceName, logError, err)
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), incusExecTimeout)
+	defer cancel()
+
+	var body map[string]interface{}
+	if remoteType == remoteBundle {
+		body, err = remoteNewBundle(ctx, sessionId, instanceName, address)
+	} else {
+		body, err = remoteNewToken(ctx, instanceName, address)
+	}
+
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to generate the remote: %v", err), 500)
+		return
+	}
+
+	// Return to the client.
+	err = json.NewEncoder(w).Encode(body)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+}
+
+// remoteGetMapping returns the proxy mapping exposing the nested Incus API with the given TLS mode.
+// The default mapping doesn't qualify as clients have no way to resolve a bare session ID.
+func remoteGetMapping(mode string) *proxyMapping {
+	mappings := config.Server.Proxy.Mappings
+
+	for i, mapping := range mappings {
+		if mapping.Port != proxyDefaultMapping.Port || mapping.TLS != mode {
+			continue
+		}
+
+		if mode == proxyTLSTerminate && !mapping.BackendTLS {
+			continue
+		}
+
+		return &mappings[i]
+	}
+
+	return nil
+}
+
+// remoteNewBundle generates a client certificate, trusts it in the instance and returns the remote configuration.
+func remoteNewBundle(ctx context.Context, sessionId int64, instanceName string, address string) (map[string]interface{}, error) {
+	// Generate the certificate.
+	cert, key, err := incusTls.GenerateMemCert(true, false)
+	if err != nil {
+		return nil, err
+	}
+
+	fingerprint, err := incusTls.CertFingerprintStr(string(cert))
+	if err != nil {
+		return nil, err
+	}
+
+	// Trust it in the instance.
+	certPath := "/tmp/incus-demo-remote.crt"
+
+	args := incus.InstanceFileArgs{
+		Content:   bytes.NewReader(cert),
+		Mode:      0600,
+		Type:      "file",
+		WriteMode: "overwrite",
+	}
+
+	err = incusDaemon.CreateInstanceFile(instanceName, certPath, args)
+	if err != nil {
+		return nil, err
+	}
+
+	req := api.InstanceExecPost{
+		Command: []string{"incus", "config", "trust", "add-certificate", certPath, "--name", "incus-demo"},
+	}
+
+	exitCode, err := incusExecContext(ctx, incusDaemon, instanceName, req, nil, nil, nil)
+	cleanupErr := incusDaemon.DeleteInstanceFile(instanceName, certPath)
+	if cleanupErr != nil {
+		slog.Warn("Failed to remove the temporary certificate", logInstance, instanceName, logError, cleanupErr)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if exitCode != 0 {
+		return nil, fmt.Errorf("Failed to trust the certificate (exit code %d)", exitCode)
+	}
+
+	// Record it for the proxy.
+	err = dbNewRemote(sessionId, fingerprint, string(cert), string(key))
+	if err != nil {
+		return nil, err
+	}
+
+	body := make(map[string]interface{})
+	body["url"] = fmt.Sprintf("https://%s", address)
+	body["server_certificate"] = config.Server.Proxy.Certificate
+	body["client_certificate"] = string(cert)
+	body["client_key"] = string(key)
+
+	return body, nil
+}
+
+// remoteNewToken issues a trust token in the instance, pointing it at the proxy.
+func remoteNewToken(ctx context.Context, instanceName string, address string) (map[string]interface{}, error) {
+	clientName := fmt.Sprintf("incus-demo-%s", strings.Split(uuid.NewRandom().String(), "-")[0])
+
+	req := api.InstanceExecPost{
+		Command: []string{"incus", "config", "trust", "add", clientName, "--quiet"},
+	}
+
+	stdout := &bytes.Buffer{}
+	exitCode, err := incusExecContext(ctx, incusDaemon, instanceName, req, nil, stdout, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if exitCode != 0 {
+		return nil, fmt.Errorf("Failed to issue a trust token (exit code %d)", exitCode)
+	}
+
+	token, err := incusTls.CertificateTokenDecode(strings.TrimSpace(stdout.String()))
+	if err != nil {
+		return nil, err
+	}
+
+	token.Addresses = []string{address}
+
+	body := make(map[string]interface{})
+	body["token"] = token.String()
+	body["command"] = fmt.Sprintf("incus remote add incus-demo %s", token.String())
+
+	return body, nil
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/lxc/incus/v6/shared/api"
+)
+
+// playgroundResult is the outcome of a snippet run, as cached and returned to the client.
+type playgroundResult struct {
+	Output    string `json:"output"`
+	ExitCode  int    `json:"exit_code"`
+	Truncated bool   `json:"truncated"`
+	TimedOut  bool   `json:"timed_out"`
+	Cached    bool   `json:"cached"`
+
+	expiry time.Time
+}
+
+// Global variables.
+var (
+	playgroundLock    sync.Mutex
+	playgroundRunning = map[string]int{}
+	playgroundCache   = map[string]*playgroundResult{}
+)
+
+func restRunHandler(w http.ResponseWriter, r *http.Request) {
+	if !config.Server.Playground.Enabled {
+		http.Error(w, "The playground is disabled", 400)
+		return
+	}
+
+	if r.Method == "OPTIONS" {
+		origin := r.Header.Get("Origin")
+		if origin != "" {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		}
+
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "Not implemented", 501)
+		return
+	}
+
+	if maintenanceEnabled() || incusDaemon == nil {
+		http.Error(w, "Server in maintenance mode", 500)
+		return
+	}
+
+	if serverIsDraining() {
+		http.Error(w, "Server is draining", 503)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	log := logRequestLogger(r)
+
+	// Extract IP.
+	requestIP, _, err := restClientIP(r)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	// Check for banned users.
+	if slices.Contains(config.Server.Blocklist, requestIP) {
+		http.Error(w, "Access denied", 403)
+		return
+	}
+
+	// Parse request.
+	req := struct {
+		Script string `json:"script"`
+		Flavor string `json:"flavor"`
+	}{}
+
+	err = json.NewDecoder(http.MaxBytesReader(w, r.Body, config.Server.Playground.MaxScript)).Decode(&req)
+	if err != nil {
+		http.Error(w, "Invalid JSON data", 400)
+		return
+	}
+
+	if req.Script == "" {
+		http.Error(w, "Missing script", 400)
+		return
+	}
+
+	if flavorGet(req.Flavor) == nil {
+		http.Error(w, "Unknown flavor", 400)
+		return
+	}
+
+	// Check the cache.
+	key := fmt.Sprintf("%x", sha256.Sum256([]byte(req.Flavor+"\x00"+req.Script)))
+	result := playgroundCached(key)
+	if result != nil {
+		err = json.NewEncoder(w).Encode(result)
+		if err != nil {
+			http.Error(w, "Internal server error", 500)
+		}
+
+		return
+	}
+
+	// Check the limits.
+	if !playgroundAcquire(requestIP) {
+		http.Error(w, "Too many snippets running, try again later", 429)
+		return
+	}
+
+	defer playgroundRelease(requestIP)
+
+	ctx, span := tracer.Start(r.Context(), "playground.run")
+	defer span.End()
+
+	result, err = playgroundRun(ctx, req.Flavor, req.Script)
+	traceEnd(span, err)
+	if err != nil {
+		log.Error("Failed to run the snippet", logError, err)
+		http.Error(w, "Unable to run the snippet", 500)
+		return
+	}
+
+	if !result.TimedOut {
+		playgroundStore(key, result)
+	}
+
+	err = json.NewEncoder(w).Encode(result)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+}
+
+// playgroundRun executes the script in a throwaway instance of the flavor.
+func playgroundRun(ctx context.Context, flavor string, script string) (*playgroundResult, error) {
+	// Take an instance from the pool, creating one if it's empty.
+	// Either way it gets a playground record so the resync leaves it alone without it counting as a session.
+	instanceExpiry := time.Now().Unix() + int64(config.Server.Playground.Timeout)
+	instanceID, instanceName, err := dbClaimAllocated(flavor, instanceExpiry)
+	if err == nil {
+		// Create a replacement instance.
+		go instancePreAllocate()
+
+		_, err = instanceStart(ctx, instanceName, nil)
+		if err != nil {
+			playgroundCleanup(instanceID, instanceName)
+			return nil, err
+		}
+	} else {
+		info, err := instanceCreate(ctx, false, instanceRequest{expiry: instanceExpiry, flavor: flavor}, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		instanceName = info["name"].(string)
+
+		instanceID, err = dbNew(
+			3,
+			info["id"].(string),
+			instanceName,
+			info["ip"].(string),
+			info["username"].(string),
+			info["password"].(string),
+			instanceExpiry,
+			0, "", "")
+		if err != nil {
+			go incusForceDelete(incusDaemon, instanceName)
+			return nil, err
+		}
+	}
+
+	defer playgroundCleanup(instanceID, instanceName)
+
+	// Run the script.
+	runCtx, cancel := context.WithTimeout(ctx, time.Duration(config.Server.Playground.Timeout)*time.Second)
+	defer cancel()
+
+	var buf bytes.Buffer
+	output := &limitWriter{Writer: &buf, limit: config.Server.Playground.MaxOutput}
+
+	req := api.InstanceExecPost{
+		Command:     []string{"sh", "-c", script},
+		Environment: map[string]string{"USER": "root", "HOME": "/root"},
+	}
+
+	exitCode, err := incusExecContext(runCtx, incusWithContext(incusDaemon, ctx), instanceName, req, nil, output, output)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &playgroundResult{
+		Output:    buf.String(),
+		ExitCode:  exitCode,
+		Truncated: output.exceeded,
+		TimedOut:  runCtx.Err() == context.DeadlineExceeded,
+	}
+
+	return result, nil
+}
+
+// playgroundCleanup deletes the instance of a playground run and its record in the background.
+func playgroundCleanup(instanceID int64, instanceName string) {
+	go func() {
+		_ = incusForceDelete(incusDaemon, instanceName)
+
+		err := dbDelete(instanceID)
+		if err != nil {
+			slog.Error("Failed to delete the playground record", logInstance, instanceName, logError, err)
+		}
+	}()
+}
+
+// playgroundAcquire reserves a run slot for the client, returning false if the limits are reached.
+func playgroundAcquire(requestIP string) bool {
+	playgroundLock.Lock()
+	defer playgroundLock.Unlock()
+
+	total := 0
+	for _, count := range playgroundRunning {
+		total += count
+	}
+
+	if total >= config.Server.Playground.Limits.Total {
+		return false
+	}
+
+	if config.Server.Playground.Limits.IP > 0 && playgroundRunning[requestIP] >= config.Server.Playground.Limits.IP {
+		return false
+	}
+
+	playgroundRunning[requestIP]++
+
+	return true
+}
+
+func playgroundRelease(requestIP string) {
+	playgroundLock.Lock()
+	defer playgroundLock.Unlock()
+
+	playgroundRunning[requestIP]--
+	if playgroundRunning[requestIP] <= 0 {
+		delete(playgroundRunning, requestIP)
+	}
+}
+
+// playgroundCached returns a copy of the cached result for the script (if any).
+func playgroundCached(key string) *playgroundResult {
+	playgroundLock.Lock()
+	defer playgroundLock.Unlock()
+
+	result, ok := playgroundCache[key]
+	if !ok || time.Now().After(result.expiry) {
+		return nil
+	}
+
+	cached := *result
+	cached.Cached = true
+
+	return &cached
+}
+
+// playgroundStore caches the result, making room by dropping expired and then the oldest entries.
+func playgroundStore(key string, result *playgroundResult) {
+	if config.Server.Playground.CacheSize <= 0 {
+		return
+	}
+
+	playgroundLock.Lock()
+	defer playgroundLock.Unlock()
+
+	now := time.Now()
+	for entryKey, entry := range playgroundCache {
+		if now.After(entry.expiry) {
+			delete(playgroundCache, entryKey)
+		}
+	}
+
+	for len(playgroundCache) >= config.Server.Playground.CacheSize {
+		var oldestKey string
+		var oldest *playgroundResult
+		for entryKey, entry := range playgroundCache {
+			if oldest == nil || entry.expiry.Before(oldest.expiry) {
+				oldestKey = entryKey
+				oldest = entry
+			}
+		}
+
+		delete(playgroundCache, oldestKey)
+	}
+
+	result.expiry = now.Add(time.Duration(config.Server.Playground.CacheExpiry) * time.Second)
+	playgroundCache[key] = result
+}
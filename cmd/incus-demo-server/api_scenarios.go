@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/lxc/incus/v6/shared/api"
+)
+
+func restScenariosHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Not implemented", 501)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	var body any
+
+	// Get the name argument.
+	name := r.FormValue("name")
+	if name != "" {
+		entry := scenarioGet(name)
+		if entry == nil {
+			http.Error(w, "Scenario not found", 404)
+			return
+		}
+
+		body = entry
+	} else {
+		entries := []map[string]any{}
+		for _, entry := range scenarioList() {
+			entries = append(entries, map[string]any{
+				"name":        entry.Name,
+				"title":       entry.Title,
+				"description": entry.Description,
+				"flavor":      entry.Flavor,
+				"steps":       len(entry.Steps),
+			})
+		}
+
+		body = entries
+	}
+
+	err := json.NewEncoder(w).Encode(body)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+}
+
+func restScenarioHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "OPTIONS" {
+		origin := r.Header.Get("Origin")
+		if origin != "" {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, PUT, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		}
+
+		return
+	}
+
+	if !slices.Contains([]string{"GET", "PUT"}, r.Method) {
+		http.Error(w, "Not implemented", 501)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	// Get the id argument.
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "Missing session id", 400)
+		return
+	}
+
+	// Get the instance.
+	sessionId, _, _, _, _, _, err := dbGetInstance(id, true)
+	if err != nil || sessionId == -1 {
+		http.Error(w, "Session not found", 404)
+		return
+	}
+
+	// Get the scenario.
+	name, step, err := dbGetScenario(sessionId)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	entry := scenarioGet(name)
+	if entry == nil {
+		http.Error(w, "Session isn't following a scenario", 404)
+		return
+	}
+
+	if r.Method == "PUT" {
+		// Parse request.
+		req := struct {
+			Step int `json:"step"`
+		}{}
+
+		err = json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, "Invalid JSON data", 400)
+			return
+		}
+
+		if req.Step < 0 || req.Step >= len(entry.Steps) {
+			http.Error(w, "Invalid step", 400)
+			return
+		}
+
+		// Steps with a check can only be moved past once they've passed.
+		if req.Step > step {
+			steps, err := dbGetScenarioSteps(sessionId, name)
+			if err != nil {
+				http.Error(w, "Internal server error", 500)
+				return
+			}
+
+			completed := map[int]bool{}
+			for _, completion := range steps {
+				completed[completion[0].(int)] = true
+			}
+
+			for i := step; i < req.Step; i++ {
+				if entry.Steps[i].HasCheck && !completed[i] {
+					http.Error(w, fmt.Sprintf("Step %d must be checked first", i+1), 400)
+					return
+				}
+			}
+		}
+
+		// Moving past steps without a check completes them.
+		for i := step; i < req.Step; i++ {
+			if entry.Steps[i].HasCheck {
+				continue
+			}
+
+			err = dbCompleteScenarioStep(sessionId, name, i)
+			if err != nil {
+				http.Error(w, "Unable to record the step", 500)
+				return
+			}
+		}
+
+		err = dbSetScenarioStep(sessionId, req.Step)
+		if err != nil {
+			http.Error(w, "Unable to record the step", 500)
+			return
+		}
+
+		step = req.Step
+	}
+
+	restScenarioProgress(w, sessionId, entry, step)
+}
+
+func restScenarioCheckHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Not implemented", 501)
+		return
+	}
+
+	if maintenanceEnabled() || incusDaemon == nil {
+		http.Error(w, "Server in maintenance mode", 500)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	// Get the id argument.
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "Missing session id", 400)
+		return
+	}
+
+	// Get the instance.
+	sessionId, instanceName, _, _, _, _, err := dbGetInstance(id, true)
+	if err != nil || sessionId == -1 {
+		http.Error(w, "Session not found", 404)
+		return
+	}
+
+	// Get the scenario.
+	name, step, err := dbGetScenario(sessionId)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	entry := scenarioGet(name)
+	if entry == nil {
+		http.Error(w, "Session isn't following a scenario", 404)
+		return
+	}
+
+	if step >= len(entry.Steps) {
+		step = len(entry.Steps) - 1
+	}
+
+	if !entry.Steps[step].HasCheck {
+		http.Error(w, "Step has no check", 400)
+		return
+	}
+
+	// Checks share the limits of the exec API.
+	if !execLimiter(id).allow(1) {
+		http.Error(w, "Too many requests", 429)
+		return
+	}
+
+	if !execAcquire(id) {
+		http.Error(w, "Too many commands running", 429)
+		return
+	}
+
+	defer execRelease(id)
+
+	// Resume the instance if it was frozen.
+	err = sessionUnfreeze(sessionId, id, instanceName)
+	if err != nil {
+		logRequestLogger(r).Error("Failed to unfreeze the session", logSession, id, logInstance, instanceName, logError, err)
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	// Run the check.
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(config.Server.Scenarios.CheckTimeout)*time.Second)
+	defer cancel()
+
+	req := api.InstanceExecPost{
+		Command:     []string{"sh", "-c", entry.Steps[step].Check},
+		Environment: map[string]string{"USER": "root", "HOME": "/root"},
+	}
+
+	exitCode, err := incusExecContext(ctx, incusDaemon, instanceName, req, nil, nil, nil)
+	if err != nil {
+		logRequestLogger(r).Error("Failed to run the step check", logSession, id, logInstance, instanceName, "scenario", name, "step", step, logError, err)
+		http.Error(w, "Unable to run the check", 500)
+		return
+	}
+
+	passed := exitCode == 0 && ctx.Err() == nil
+	if passed {
+		err = dbCompleteScenarioStep(sessionId, name, step)
+		if err != nil {
+			http.Error(w, "Unable to record the step", 500)
+			return
+		}
+
+		// Advance to the next step.
+		if step+1 < len(entry.Steps) {
+			step++
+
+			err = dbSetScenarioStep(sessionId, step)
+			if err != nil {
+				http.Error(w, "Unable to record the step", 500)
+				return
+			}
+		}
+	}
+
+	body := make(map[string]interface{})
+	body["passed"] = passed
+	body["step"] = step
+
+	err = json.NewEncoder(w).Encode(body)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+}
+
+// restScenarioProgress returns the scenario of a session, its current step and the steps completed so far.
+func restScenarioProgress(w http.ResponseWriter, sessionId int64, entry *scenario, step int) {
+	// The scenario may have been shortened since the step was recorded.
+	if step >= len(entry.Steps) {
+		step = len(entry.Steps) - 1
+	}
+
+	steps, err := dbGetScenarioSteps(sessionId, entry.Name)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	completed := map[int]int{}
+	for _, completion := range steps {
+		completed[completion[0].(int)] = completion[1].(int)
+	}
+
+	body := make(map[string]interface{})
+	body["scenario"] = entry
+	body["step"] = step
+	body["completed"] = completed
+
+	err = json.NewEncoder(w).Encode(body)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+}
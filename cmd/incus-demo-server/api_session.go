@@ -2,16 +2,14 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"net/http"
 	"slices"
 	"strconv"
 	"time"
 
 	"github.com/gorilla/websocket"
-	"github.com/lxc/incus/v6/client"
-	"github.com/lxc/incus/v6/shared/api"
 )
 
 func restStartHandler(w http.ResponseWriter, r *http.Request) {
@@ -20,7 +18,7 @@ func restStartHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if config.Server.Maintenance.Enabled || incusDaemon == nil {
+	if maintenanceEnabled() || incusDaemon == nil {
 		http.Error(w, "Server in maintenance mode", 500)
 		return
 	}
@@ -45,11 +43,21 @@ func restStartHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	requestDate := time.Now().Unix()
+	log := logRequestLogger(r)
+
+	ctx, span := tracer.Start(r.Context(), "session.start")
+	defer span.End()
+
+	// Refuse new sessions while draining.
+	if serverIsDraining() {
+		restStartError(w, log, nil, instanceDraining)
+		return
+	}
 
 	// Extract IP.
-	requestIP, _, err := restClientIP(r)
+	requestIP, requestProtocol, err := restClientIP(r)
 	if err != nil {
-		restStartError(w, err, instanceUnknownError)
+		restStartError(w, log, err, instanceUnknownError)
 		return
 	}
 
@@ -61,13 +69,40 @@ func restStartHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if requestTerms != config.Server.termsHash {
-		restStartError(w, nil, instanceInvalidTerms)
+		restStartError(w, log, nil, instanceInvalidTerms)
 		return
 	}
 
 	// Check for banned users.
 	if slices.Contains(config.Server.Blocklist, requestIP) {
-		restStartError(w, nil, instanceUserBanned)
+		restStartError(w, log, nil, instanceUserBanned)
+		return
+	}
+
+	// Check the requested scenario.
+	scenarioName := r.FormValue("scenario")
+	flavorName := r.FormValue("flavor")
+	if scenarioName != "" {
+		entry := scenarioGet(scenarioName)
+		if entry == nil {
+			restStartError(w, log, fmt.Errorf("Unknown scenario %q", scenarioName), instanceUnknownError)
+			return
+		}
+
+		// Scenarios run on their own flavor.
+		if entry.Flavor != "" {
+			if flavorName != "" && flavorName != entry.Flavor {
+				restStartError(w, log, fmt.Errorf("Scenario %q requires flavor %q", scenarioName, entry.Flavor), instanceUnknownError)
+				return
+			}
+
+			flavorName = entry.Flavor
+		}
+	}
+
+	// Check the requested flavor.
+	if flavorGet(flavorName) == nil {
+		restStartError(w, log, fmt.Errorf("Unknown flavor %q", flavorName), instanceUnknownError)
 		return
 	}
 
@@ -79,7 +114,7 @@ func restStartHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Server is full.
 	if instanceCount >= config.Server.Limits.Total {
-		restStartError(w, nil, instanceServerFull)
+		restStartError(w, log, nil, instanceServerFull)
 		return
 	}
 
@@ -90,16 +125,24 @@ func restStartHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if config.Server.Limits.IP != 0 && instanceCount >= config.Server.Limits.IP {
-		restStartError(w, nil, instanceQuotaReached)
+		restStartError(w, log, nil, instanceQuotaReached)
+		return
+	}
+
+	// Make sure the session ends before the next maintenance window.
+	sessionExpiry, err := maintenanceSessionExpiry(config.Session.Expiry)
+	if err != nil {
+		log.Info("Session refused due to upcoming maintenance", logError, err)
+		restStartError(w, log, nil, instanceMaintenance)
 		return
 	}
 
 	// Create the instance.
 	var instanceID int64
 	info := map[string]any{}
-	instanceExpiry := time.Now().Unix() + int64(config.Session.Expiry)
+	instanceExpiry := time.Now().Unix() + int64(sessionExpiry)
 
-	id, instanceUUID, instanceName, instanceIP, instanceUsername, instancePassword, err := dbGetAllocated(instanceExpiry, requestDate, requestIP, requestTerms)
+	id, instanceUUID, instanceName, instanceIP, instanceUsername, instancePassword, err := dbGetAllocated(flavorName, instanceExpiry, requestDate, requestIP, requestTerms)
 	if err == nil {
 		// Use a pre-created instance.
 		instanceID = id
@@ -114,20 +157,22 @@ func restStartHandler(w http.ResponseWriter, r *http.Request) {
 		go instancePreAllocate()
 
 		// Start if not started yet.
-		_, err = instanceStart(instanceName, statusUpdate)
+		_, err = instanceStart(ctx, instanceName, statusUpdate)
 		if err != nil {
-			restStartError(w, err, instanceUnknownError)
+			metricCreateFailures.inc("")
+			restStartError(w, log, err, instanceUnknownError)
 			return
 		}
 	} else {
 		// Fallback to creating a new one.
-		info, err = instanceCreate(false, statusUpdate)
+		info, err = instanceCreate(ctx, false, instanceRequest{expiry: instanceExpiry, protocol: requestProtocol, flavor: flavorName}, statusUpdate)
 		if err != nil {
-			restStartError(w, err, instanceUnknownError)
+			metricCreateFailures.inc("")
+			restStartError(w, log, err, instanceUnknownError)
 			return
 		}
 
-		instanceExpiry = time.Now().Unix() + int64(config.Session.Expiry)
+		instanceExpiry = time.Now().Unix() + int64(sessionExpiry)
 		instanceID, err = dbNew(
 			0,
 			info["id"].(string),
@@ -138,33 +183,51 @@ func restStartHandler(w http.ResponseWriter, r *http.Request) {
 			instanceExpiry, requestDate, requestIP, requestTerms)
 		if err != nil {
 			incusForceDelete(incusDaemon, info["name"].(string))
-			restStartError(w, err, instanceUnknownError)
+			restStartError(w, log, err, instanceUnknownError)
 			return
 		}
 
 		info["expiry"] = instanceExpiry
 	}
 
-	// Setup cleanup code.
-	duration, err := time.ParseDuration(fmt.Sprintf("%ds", config.Session.Expiry))
-	if err != nil {
-		incusForceDelete(incusDaemon, info["name"].(string))
-		restStartError(w, err, instanceUnknownError)
-		return
+	log = log.With(logSession, info["id"], logInstance, info["name"])
+	span.SetAttributes(traceSession.String(info["id"].(string)), traceInstance.String(info["name"].(string)))
+
+	// Record the flavor of the session.
+	if flavorName != "" {
+		err = dbSetFlavor(instanceID, flavorName)
+		if err != nil {
+			incusForceDelete(incusDaemon, info["name"].(string))
+			restStartError(w, log, err, instanceUnknownError)
+			return
+		}
+
+		info["flavor"] = flavorName
 	}
 
-	time.AfterFunc(duration, func() {
-		incusForceDelete(incusDaemon, info["name"].(string))
-		dbExpire(instanceID)
-	})
+	// Record the scenario the session follows.
+	if scenarioName != "" {
+		err = dbSetScenario(instanceID, scenarioName)
+		if err != nil {
+			incusForceDelete(incusDaemon, info["name"].(string))
+			restStartError(w, log, err, instanceUnknownError)
+			return
+		}
+
+		info["scenario"] = scenarioName
+	}
+
+	// Setup cleanup code.
+	sessionSchedule(instanceID, info["id"].(string), info["name"].(string), info["expiry"].(int64))
 
 	err = json.NewEncoder(w).Encode(info)
 	if err != nil {
 		incusForceDelete(incusDaemon, info["name"].(string))
-		restStartError(w, err, instanceUnknownError)
+		restStartError(w, log, err, instanceUnknownError)
 		return
 	}
 
+	log.Info("Session started")
 	flusher.Flush()
 	return
 }
@@ -175,7 +238,7 @@ func restInfoHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if config.Server.Maintenance.Enabled || incusDaemon == nil {
+	if maintenanceEnabled() || incusDaemon == nil {
 		http.Error(w, "Server in maintenance mode", 500)
 		return
 	}
@@ -207,6 +270,12 @@ func restInfoHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	body["id"] = id
 	body["expiry"] = instanceExpiry
+	body["idle_timeout"] = config.Session.IdleTimeout
+
+	body["state"] = "running"
+	if sessionIsFrozen(sessionId) {
+		body["state"] = "frozen"
+	}
 
 	// Return to the client.
 	body["status"] = instanceStarted
@@ -224,24 +293,84 @@ func restConsoleHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if config.Server.Maintenance.Enabled || incusDaemon == nil {
+	if maintenanceEnabled() || incusDaemon == nil {
 		http.Error(w, "Server in maintenance mode", 500)
 		return
 	}
 
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 
-	// Get the id argument.
+	// Get the id or invite argument.
 	id := r.FormValue("id")
-	if id == "" {
+	inviteToken := r.FormValue("invite")
+	if id == "" && inviteToken == "" {
 		http.Error(w, "Missing session id", 400)
 		return
 	}
 
-	// Get the instance.
-	sessionId, instanceName, _, _, _, _, err := dbGetInstance(id, true)
-	if err != nil || sessionId == -1 {
-		http.Error(w, "Session not found", 404)
+	var sessionId int64
+	var inviteID int64
+	var inviteMode string
+	var instanceName string
+
+	if inviteToken != "" {
+		// Extract IP.
+		requestIP, _, err := restClientIP(r)
+		if err != nil {
+			http.Error(w, "Internal server error", 500)
+			return
+		}
+
+		// Invited users must accept the terms themselves.
+		requestTerms := r.FormValue("terms")
+		if requestTerms == "" {
+			http.Error(w, "Missing terms hash", 400)
+			return
+		}
+
+		if requestTerms != config.Server.termsHash {
+			http.Error(w, "Invalid terms hash", 400)
+			return
+		}
+
+		// Check for banned users.
+		if slices.Contains(config.Server.Blocklist, requestIP) {
+			http.Error(w, "User is banned", 403)
+			return
+		}
+
+		// Get the invite.
+		inviteID, sessionId, id, instanceName, inviteMode, err = dbGetInvite(inviteToken)
+		if err != nil || inviteID == -1 {
+			http.Error(w, "Invite not found", 404)
+			return
+		}
+
+		// Record the guest.
+		err = dbRecordGuest(sessionId, inviteID, time.Now().Unix(), requestIP, requestTerms)
+		if err != nil {
+			http.Error(w, "Internal server error", 500)
+			return
+		}
+	} else {
+		// Get the instance.
+		var err error
+		sessionId, instanceName, _, _, _, _, err = dbGetInstance(id, true)
+		if err != nil || sessionId == -1 {
+			http.Error(w, "Session not found", 404)
+			return
+		}
+	}
+
+	// Register the console first so the idle monitor can't freeze the instance once resumed.
+	activityConnect(id)
+	defer activityDisconnect(id)
+
+	// Resume the instance if it was frozen.
+	err := sessionUnfreeze(sessionId, id, instanceName)
+	if err != nil {
+		logRequestLogger(r).Error("Failed to unfreeze the session", logSession, id, logInstance, instanceName, logError, err)
+		http.Error(w, "Internal server error", 500)
 		return
 	}
 
@@ -260,13 +389,25 @@ func restConsoleHandler(w http.ResponseWriter, r *http.Request) {
 	widthInt, err := strconv.Atoi(width)
 	if err != nil {
 		http.Error(w, "Invalid width value", 400)
+		return
 	}
 
 	heightInt, err := strconv.Atoi(height)
 	if err != nil {
-		http.Error(w, "Invalid width value", 400)
+		http.Error(w, "Invalid height value", 400)
+		return
 	}
 
+	// Get the console mode of the session flavor.
+	flavor, err := flavorSession(sessionId)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	// Get the key the client will use to address its terminal.
+	terminalKey := r.FormValue("terminal")
+
 	// Setup websocket with the client.
 	upgrader := websocket.Upgrader{
 		ReadBufferSize:  1024,
@@ -283,60 +424,85 @@ func restConsoleHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer conn.Close()
 
-	// Connect to the instance.
-	env := make(map[string]string)
-	env["USER"] = "root"
-	env["HOME"] = "/root"
-	env["TERM"] = "xterm"
-
-	inRead, inWrite := io.Pipe()
-	outRead, outWrite := io.Pipe()
-
-	// Data handler.
 	connWrapper := &wsWrapper{conn: conn}
-	go io.Copy(inWrite, connWrapper)
-	go io.Copy(connWrapper, outRead)
-
-	// Control socket handler.
-	handler := func(conn *websocket.Conn) {
-		for {
-			_, _, err = conn.ReadMessage()
-			if err != nil {
-				break
-			}
+
+	// Attach to the shared terminal if requested.
+	if inviteMode == inviteShared {
+		terminal := consoleGetShared(id)
+		if terminal != nil {
+			terminal.add(connWrapper, inviteID, terminalKey)
+			terminal.attach(connWrapper)
+			return
 		}
 	}
 
-	// Send the exec request.
-	req := api.InstanceExecPost{
-		Command:     config.Session.Command,
-		WaitForWS:   true,
-		Interactive: true,
-		Environment: env,
-		Width:       widthInt,
-		Height:      heightInt,
+	// Spawn a new terminal.
+	terminal := consoleNew(id, instanceName, flavor.ConsoleMode, inviteMode != inviteSeparate)
+	terminal.add(connWrapper, inviteID, terminalKey)
+
+	err = terminal.start(widthInt, heightInt)
+	if err != nil {
+		logRequestLogger(r).Error("Failed to start console", logSession, id, logInstance, instanceName, logError, err)
+		return
 	}
 
-	execArgs := incus.InstanceExecArgs{
-		Stdin:    inRead,
-		Stdout:   outWrite,
-		Stderr:   outWrite,
-		Control:  handler,
-		DataDone: make(chan bool),
+	terminal.attach(connWrapper)
+}
+
+func restConsoleResizeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Not implemented", 501)
+		return
 	}
 
-	op, err := incusDaemon.ExecInstance(instanceName, req, &execArgs)
-	if err != nil {
+	if maintenanceEnabled() || incusDaemon == nil {
+		http.Error(w, "Server in maintenance mode", 500)
 		return
 	}
 
-	err = op.Wait()
-	if err != nil {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	// Get the id argument.
+	id := r.FormValue("id")
+	if id == "" {
+		http.Error(w, "Missing session id", 400)
+		return
+	}
+
+	// Get the instance.
+	sessionId, _, _, _, _, _, err := dbGetInstance(id, true)
+	if err != nil || sessionId == -1 {
+		http.Error(w, "Session not found", 404)
 		return
 	}
 
-	<-execArgs.DataDone
+	// Get the terminal key.
+	terminalKey := r.FormValue("terminal")
+	if terminalKey == "" {
+		http.Error(w, "Missing terminal", 400)
+		return
+	}
 
-	inWrite.Close()
-	outRead.Close()
+	// Get console width and height.
+	widthInt, err := strconv.Atoi(r.FormValue("width"))
+	if err != nil || widthInt <= 0 {
+		http.Error(w, "Invalid width value", 400)
+		return
+	}
+
+	heightInt, err := strconv.Atoi(r.FormValue("height"))
+	if err != nil || heightInt <= 0 {
+		http.Error(w, "Invalid height value", 400)
+		return
+	}
+
+	// Resize the client's terminal.
+	err = consoleResize(id, terminalKey, widthInt, heightInt)
+	if errors.Is(err, errConsoleNotFound) {
+		http.Error(w, "Terminal not found", 404)
+		return
+	} else if err != nil {
+		http.Error(w, "Unable to resize the terminal", 500)
+		return
+	}
 }
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"sync"
+
+	"github.com/lxc/incus/v6/shared/api"
+)
+
+// snapshotPristine is the automatic snapshot taken once the instance is ready, used to reset it.
+const snapshotPristine = "pristine"
+
+var snapshotNameRegex = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]{0,31}$`)
+
+// Snapshot changes are serialized per session so the limits can't be raced past.
+var (
+	snapshotsRunningLock sync.Mutex
+	snapshotsRunning     = map[int64]bool{}
+)
+
+func restSnapshotsHandler(w http.ResponseWriter, r *http.Request) {
+	if maintenanceEnabled() || incusDaemon == nil {
+		http.Error(w, "Server in maintenance mode", 500)
+		return
+	}
+
+	if r.Method == "OPTIONS" {
+		origin := r.Header.Get("Origin")
+		if origin != "" {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		}
+
+		return
+	}
+
+	if !slices.Contains([]string{"GET", "POST", "PUT", "DELETE"}, r.Method) {
+		http.Error(w, "Not implemented", 501)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	// Get the id argument.
+	id := r.FormValue("id")
+	if id == "" {
+		http.Error(w, "Missing session id", 400)
+		return
+	}
+
+	// Get the instance.
+	sessionId, instanceName, _, _, _, _, err := dbGetInstance(id, true)
+	if err != nil || sessionId == -1 {
+		http.Error(w, "Session not found", 404)
+		return
+	}
+
+	// Get the flavor.
+	flavor, err := flavorSession(sessionId)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	if *flavor.Snapshots.Limit <= 0 {
+		http.Error(w, "Snapshots are disabled", 400)
+		return
+	}
+
+	if r.Method == "GET" {
+		restSnapshotsGetHandler(w, instanceName, flavor)
+		return
+	}
+
+	// Get the name argument.
+	name := r.FormValue("name")
+	if !snapshotNameRegex.MatchString(name) || name == snapshotPristine {
+		http.Error(w, "Invalid snapshot name", 400)
+		return
+	}
+
+	// Only one snapshot change at a time.
+	snapshotsRunningLock.Lock()
+	if snapshotsRunning[sessionId] {
+		snapshotsRunningLock.Unlock()
+		http.Error(w, "A snapshot operation is already running", 409)
+		return
+	}
+
+	snapshotsRunning[sessionId] = true
+	snapshotsRunningLock.Unlock()
+
+	defer func() {
+		snapshotsRunningLock.Lock()
+		delete(snapshotsRunning, sessionId)
+		snapshotsRunningLock.Unlock()
+	}()
+
+	if r.Method == "POST" {
+		restSnapshotsPostHandler(w, instanceName, name, flavor)
+		return
+	}
+
+	if r.Method == "PUT" {
+		restSnapshotsRestore(w, r, sessionId, id, instanceName, name)
+		return
+	}
+
+	op, err := incusDaemon.DeleteInstanceSnapshot(instanceName, name)
+	if err == nil {
+		err = op.Wait()
+	}
+
+	if err != nil {
+		http.Error(w, "Unable to delete the snapshot", 500)
+		return
+	}
+}
+
+func restSnapshotsGetHandler(w http.ResponseWriter, instanceName string, flavor *instanceFlavor) {
+	w.Header().Set("Content-Type", "application/json")
+
+	snapshots, err := snapshotsList(instanceName)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	entries := []map[string]any{}
+	reset := false
+	for _, snapshot := range snapshots {
+		if snapshot.Name == snapshotPristine {
+			reset = true
+			continue
+		}
+
+		entries = append(entries, map[string]any{
+			"name":       snapshot.Name,
+			"created_at": snapshot.CreatedAt.Unix(),
+			"size":       snapshot.Size,
+		})
+	}
+
+	body := make(map[string]interface{})
+	body["snapshots"] = entries
+	body["limit"] = *flavor.Snapshots.Limit
+	body["max_size"] = *flavor.Snapshots.MaxSize
+	body["reset"] = reset
+
+	err = json.NewEncoder(w).Encode(body)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+}
+
+func restSnapshotsPostHandler(w http.ResponseWriter, instanceName string, name string, flavor *instanceFlavor) {
+	// Check the snapshot count.
+	snapshots, err := snapshotsList(instanceName)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	count := 0
+	for _, snapshot := range snapshots {
+		if snapshot.Name == name {
+			http.Error(w, "Snapshot already exists", 409)
+			return
+		}
+
+		if snapshot.Name != snapshotPristine {
+			count++
+		}
+	}
+
+	if count >= *flavor.Snapshots.Limit {
+		http.Error(w, "Snapshot limit reached", 403)
+		return
+	}
+
+	// Create the snapshot.
+	op, err := incusDaemon.CreateInstanceSnapshot(instanceName, api.InstanceSnapshotsPost{Name: name})
+	if err == nil {
+		err = op.Wait()
+	}
+
+	if err != nil {
+		http.Error(w, "Unable to create the snapshot", 500)
+		return
+	}
+
+	// Check the size of the snapshots.
+	if *flavor.Snapshots.MaxSize > 0 {
+		snapshots, err = snapshotsList(instanceName)
+		if err != nil {
+			http.Error(w, "Internal server error", 500)
+			return
+		}
+
+		var size int64
+		for _, snapshot := range snapshots {
+			if snapshot.Name != snapshotPristine {
+				size += snapshot.Size
+			}
+		}
+
+		if size > *flavor.Snapshots.MaxSize {
+			op, err := incusDaemon.DeleteInstanceSnapshot(instanceName, name)
+			if err == nil {
+				_ = op.Wait()
+			}
+
+			http.Error(w, "Snapshot size limit reached", 413)
+			return
+		}
+	}
+}
+
+// restSnapshotsRestore restores the instance to the provided snapshot.
+func restSnapshotsRestore(w http.ResponseWriter, r *http.Request, sessionId int64, id string, instanceName string, name string) {
+	// Resume the instance if it was frozen.
+	err := sessionUnfreeze(sessionId, id, instanceName)
+	if err != nil {
+		logRequestLogger(r).Error("Failed to unfreeze the session", logSession, id, logInstance, instanceName, logError, err)
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	op, err := incusDaemon.UpdateInstance(instanceName, api.InstancePut{Restore: name}, "")
+	if err == nil {
+		err = op.Wait()
+	}
+
+	if err != nil {
+		logRequestLogger(r).Error("Failed to restore the snapshot", logSession, id, logInstance, instanceName, "snapshot", name, logError, err)
+		http.Error(w, "Unable to restore the snapshot", 500)
+		return
+	}
+}
+
+func restResetHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Not implemented", 501)
+		return
+	}
+
+	if !config.Session.Snapshots.Reset {
+		http.Error(w, "Instance reset is disabled", 400)
+		return
+	}
+
+	if maintenanceEnabled() || incusDaemon == nil {
+		http.Error(w, "Server in maintenance mode", 500)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	// Get the id argument.
+	id := r.FormValue("id")
+	if id == "" {
+		http.Error(w, "Missing session id", 400)
+		return
+	}
+
+	// Get the instance.
+	sessionId, instanceName, _, _, _, _, err := dbGetInstance(id, true)
+	if err != nil || sessionId == -1 {
+		http.Error(w, "Session not found", 404)
+		return
+	}
+
+	restSnapshotsRestore(w, r, sessionId, id, instanceName, snapshotPristine)
+}
+
+// snapshotsList returns the snapshots of the instance.
+func snapshotsList(instanceName string) ([]api.InstanceSnapshot, error) {
+	snapshots, err := incusDaemon.GetInstanceSnapshots(instanceName)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list snapshots: %w", err)
+	}
+
+	return snapshots, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+
+	"github.com/pborman/uuid"
+	"golang.org/x/crypto/ssh"
+)
+
+type sshKey struct {
+	Key string `json:"key"`
+}
+
+func restSSHHandler(w http.ResponseWriter, r *http.Request) {
+	if config.Server.SSH.Address == "" {
+		http.Error(w, "SSH access is disabled", 400)
+		return
+	}
+
+	if maintenanceEnabled() || incusDaemon == nil {
+		http.Error(w, "Server in maintenance mode", 500)
+		return
+	}
+
+	if r.Method == "POST" {
+		restSSHPostHandler(w, r)
+		return
+	}
+
+	if r.Method == "GET" {
+		restSSHGetHandler(w, r)
+		return
+	}
+
+	if r.Method == "OPTIONS" {
+		origin := r.Header.Get("Origin")
+		if origin != "" {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		}
+
+		return
+	}
+
+	http.Error(w, "Not implemented", 501)
+}
+
+func restSSHGetHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	// Get the id argument.
+	id := r.FormValue("id")
+	if id == "" {
+		http.Error(w, "Missing session id", 400)
+		return
+	}
+
+	// Get the instance.
+	sessionId, _, _, _, _, _, err := dbGetInstance(id, true)
+	if err != nil || sessionId == -1 {
+		http.Error(w, "Session not found", 404)
+		return
+	}
+
+	// Get the existing credentials.
+	credentials, err := dbGetSSHCredentials(sessionId)
+	if err != nil {
+		http.Error(w, "Unable to retrieve the SSH credentials", 500)
+		return
+	}
+
+	var secret string
+	keys := []string{}
+	for _, entry := range credentials {
+		if entry[0].(string) == sshCredentialSecret {
+			secret = entry[1].(string)
+		} else if entry[0].(string) == sshCredentialKey {
+			keys = append(keys, entry[1].(string))
+		}
+	}
+
+	// Generate a secret on first use.
+	if secret == "" {
+		secret = uuid.NewRandom().String()
+
+		err = dbNewSSHCredential(sessionId, sshCredentialSecret, secret)
+		if err != nil {
+			http.Error(w, "Unable to record the SSH credentials", 500)
+			return
+		}
+	}
+
+	_, port, err := net.SplitHostPort(config.Server.SSH.Address)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	// Generate the response.
+	body := make(map[string]interface{})
+	body["port"] = port
+	body["username"] = id
+	body["secret"] = secret
+	body["keys"] = keys
+
+	err = json.NewEncoder(w).Encode(body)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+}
+
+func restSSHPostHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	// Get the id argument.
+	id := r.FormValue("id")
+	if id == "" {
+		http.Error(w, "Missing session id", 400)
+		return
+	}
+
+	// Get the instance.
+	sessionId, _, _, _, _, _, err := dbGetInstance(id, true)
+	if err != nil || sessionId == -1 {
+		http.Error(w, "Session not found", 404)
+		return
+	}
+
+	// Parse request.
+	key := sshKey{}
+
+	err = json.NewDecoder(r.Body).Decode(&key)
+	if err != nil {
+		http.Error(w, "Invalid JSON data", 400)
+		return
+	}
+
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key.Key))
+	if err != nil {
+		http.Error(w, "Invalid SSH public key", 400)
+		return
+	}
+
+	// Record the key.
+	err = dbNewSSHCredential(sessionId, sshCredentialKey, string(ssh.MarshalAuthorizedKey(publicKey)))
+	if err != nil {
+		http.Error(w, "Unable to record the SSH credentials", 500)
+		return
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
@@ -47,6 +48,13 @@ func restStatisticsHandler(w http.ResponseWriter, r *http.Request) {
 		statsPeriod = "total"
 	}
 
+	// State filtering.
+	statsState := r.FormValue("state")
+	if !slices.Contains([]string{"", "frozen", "running"}, statsState) {
+		http.Error(w, "Invalid state", 400)
+		return
+	}
+
 	// Network filtering.
 	requestNetwork := r.FormValue("network")
 	var statsNetwork *net.IPNet
@@ -59,7 +67,7 @@ func restStatisticsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Query the database.
-	count, err := dbGetStats(statsPeriod, statsUnique, statsNetwork)
+	count, err := dbGetStats(statsPeriod, statsState, statsUnique, statsNetwork)
 	if err != nil {
 		http.Error(w, "Unable to retrieve statistics", 500)
 		return
@@ -68,3 +76,53 @@ func restStatisticsHandler(w http.ResponseWriter, r *http.Request) {
 	// Return to client.
 	w.Write([]byte(fmt.Sprintf("%d\n", count)))
 }
+
+func restStatisticsScenariosHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Not implemented", 501)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	// Validate API key.
+	requestKey := r.FormValue("key")
+	if !slices.Contains(config.Server.Statistics.Keys, requestKey) {
+		http.Error(w, "Invalid authentication key", 401)
+		return
+	}
+
+	// Get the scenario.
+	entry := scenarioGet(r.FormValue("name"))
+	if entry == nil {
+		http.Error(w, "Scenario not found", 404)
+		return
+	}
+
+	// Query the database.
+	started, completed, err := dbGetScenarioFunnel(entry.Name)
+	if err != nil {
+		http.Error(w, "Unable to retrieve statistics", 500)
+		return
+	}
+
+	steps := []map[string]any{}
+	for i, step := range entry.Steps {
+		steps = append(steps, map[string]any{
+			"title":     step.Title,
+			"completed": completed[i],
+		})
+	}
+
+	body := make(map[string]interface{})
+	body["started"] = started
+	body["steps"] = steps
+
+	// Return to client.
+	err = json.NewEncoder(w).Encode(body)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"net/http"
+	"time"
 )
 
 type serverStatusCode int
@@ -10,6 +11,7 @@ type serverStatusCode int
 const (
 	serverOperational serverStatusCode = 0
 	serverMaintenance serverStatusCode = 1
+	serverDraining    serverStatusCode = 2
 )
 
 func restStatusHandler(w http.ResponseWriter, r *http.Request) {
@@ -52,13 +54,30 @@ func restStatusHandler(w http.ResponseWriter, r *http.Request) {
 	body["client_protocol"] = protocol
 	body["feedback"] = config.Server.Feedback.Enabled
 	body["session_console_only"] = config.Session.ConsoleOnly
+	body["session_console_mode"] = config.Session.ConsoleMode
 	body["session_network"] = config.Session.Network
-	if !config.Server.Maintenance.Enabled && !failure && incusDaemon != nil {
-		body["server_status"] = serverOperational
-	} else {
+	body["flavors"] = flavorList()
+	if maintenanceEnabled() || failure || incusDaemon == nil {
 		body["server_status"] = serverMaintenance
-		body["server_message"] = config.Server.Maintenance.Message
+		body["server_message"] = maintenanceMessage()
+	} else if serverIsDraining() {
+		body["server_status"] = serverDraining
+		body["server_message"] = config.Server.Drain.Message
+	} else {
+		body["server_status"] = serverOperational
 	}
+	body["announcements"] = announcementsActive()
+
+	// Advertise upcoming maintenance.
+	window := maintenanceNext()
+	if window != nil && time.Until(window.Start) <= time.Duration(config.Server.Maintenance.Notice)*time.Second {
+		body["maintenance_next"] = map[string]any{
+			"start":   window.Start.Unix(),
+			"end":     window.End.Unix(),
+			"message": window.Message,
+		}
+	}
+
 	body["instance_count"] = instanceCount
 	body["instance_max"] = config.Server.Limits.Total
 	body["instance_next"] = instanceNext
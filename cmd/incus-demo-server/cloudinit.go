@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// instanceRequest holds what's known about the user an instance is created for (empty for pre-allocated instances).
+type instanceRequest struct {
+	expiry   int64
+	protocol string
+	flavor   string
+}
+
+// cloudInitVars are the variables available to the cloud-init templates.
+type cloudInitVars struct {
+	Username string
+	Password string
+	UUID     string
+	Expiry   int64
+	Protocol string
+	Flavor   string
+}
+
+// cloudInitLoad reads and parses a cloud-init template, making sure it renders to valid YAML.
+func cloudInitLoad(t *cloudInitTemplate, name string) error {
+	t.tpl = nil
+
+	if t.Content != "" && t.File != "" {
+		return fmt.Errorf("Only one of content or file can be specified for the cloud-init %s", name)
+	}
+
+	content := t.Content
+	if t.File != "" {
+		data, err := os.ReadFile(t.File)
+		if err != nil {
+			return fmt.Errorf("Unable to read the cloud-init %s: %w", name, err)
+		}
+
+		content = string(data)
+	}
+
+	if content == "" {
+		return nil
+	}
+
+	tpl, err := template.New(name).Parse(content)
+	if err != nil {
+		return fmt.Errorf("Unable to parse the cloud-init %s: %w", name, err)
+	}
+
+	// Render with sample values to validate the result.
+	var sb strings.Builder
+	err = tpl.Execute(&sb, cloudInitVars{
+		Username: "admin",
+		Password: "password",
+		UUID:     "00000000-0000-0000-0000-000000000000",
+		Expiry:   time.Now().Unix(),
+		Protocol: "IPv6",
+		Flavor:   "",
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to render the cloud-init %s: %w", name, err)
+	}
+
+	var out any
+	err = yaml.Unmarshal([]byte(sb.String()), &out)
+	if err != nil {
+		return fmt.Errorf("The cloud-init %s isn't valid YAML: %w", name, err)
+	}
+
+	t.tpl = tpl
+
+	return nil
+}
+
+// cloudInitEnabled returns whether any of the cloud-init templates is set.
+func cloudInitEnabled() bool {
+	cloudInit := config.Instance.CloudInit
+
+	return cloudInit.UserData.tpl != nil || cloudInit.VendorData.tpl != nil || cloudInit.NetworkConfig.tpl != nil
+}
+
+// cloudInitRender renders the template, returning an empty string if it isn't set.
+func cloudInitRender(t cloudInitTemplate, vars cloudInitVars) (string, error) {
+	if t.tpl == nil {
+		return "", nil
+	}
+
+	var sb strings.Builder
+	err := t.tpl.Execute(&sb, vars)
+	if err != nil {
+		return "", err
+	}
+
+	return sb.String(), nil
+}
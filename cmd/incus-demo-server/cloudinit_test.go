@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCloudInitLoad(t *testing.T) {
+	userData := "#cloud-config\nusers:\n  - name: {{ .Username }}\n"
+
+	file := filepath.Join(t.TempDir(), "user-data")
+	err := os.WriteFile(file, []byte(userData), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		template cloudInitTemplate
+		vars     cloudInitVars
+		want     string
+		wantErr  bool
+	}{
+		{name: "unset", want: ""},
+		{name: "inline", template: cloudInitTemplate{Content: userData}, vars: cloudInitVars{Username: "admin"}, want: "#cloud-config\nusers:\n  - name: admin\n"},
+		{name: "from a file", template: cloudInitTemplate{File: file}, vars: cloudInitVars{Username: "user"}, want: "#cloud-config\nusers:\n  - name: user\n"},
+		{name: "default flavor", template: cloudInitTemplate{Content: "flavor: {{ if .Flavor }}{{ .Flavor }}{{ else }}main{{ end }}\n"}, want: "flavor: main\n"},
+		{name: "all variables", template: cloudInitTemplate{Content: "a: {{ .Password }}\nb: {{ .UUID }}\nc: {{ .Expiry }}\nd: {{ .Protocol }}\ne: {{ .Flavor }}\n"}, vars: cloudInitVars{Password: "p", UUID: "u", Expiry: 42, Protocol: "IPv4", Flavor: "vm"}, want: "a: p\nb: u\nc: 42\nd: IPv4\ne: vm\n"},
+		{name: "content and file", template: cloudInitTemplate{Content: userData, File: file}, wantErr: true},
+		{name: "missing file", template: cloudInitTemplate{File: filepath.Join(t.TempDir(), "missing")}, wantErr: true},
+		{name: "invalid template", template: cloudInitTemplate{Content: "users: {{ .Username"}, wantErr: true},
+		{name: "unknown variable", template: cloudInitTemplate{Content: "users: {{ .Missing }}\n"}, wantErr: true},
+		{name: "invalid YAML", template: cloudInitTemplate{Content: "users: [{{ .Username }}\n"}, wantErr: true},
+		{name: "invalid YAML for the default flavor", template: cloudInitTemplate{Content: "{{ if not .Flavor }}users: [{{ end }}\n"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tpl := tt.template
+
+			err := cloudInitLoad(&tpl, "user-data")
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("cloudInitLoad succeeded, expected an error")
+				}
+
+				if tpl.tpl != nil {
+					t.Fatal("cloudInitLoad kept the template after failing")
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("cloudInitLoad failed: %v", err)
+			}
+
+			got, err := cloudInitRender(tpl, tt.vars)
+			if err != nil {
+				t.Fatalf("cloudInitRender failed: %v", err)
+			}
+
+			if got != tt.want {
+				t.Fatalf("cloudInitRender = %q, expected %q", got, tt.want)
+			}
+		})
+	}
+}
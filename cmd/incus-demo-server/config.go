@@ -1,13 +1,29 @@
 package main
 
+import (
+	"text/template"
+	"time"
+)
+
 type serverConfig struct {
 	Server struct {
+		Admin struct {
+			Keys []string `yaml:"keys"`
+		} `yaml:"admin"`
+
+		Announcements []announcement `yaml:"announcements"`
+
 		API struct {
 			Address string `yaml:"address"`
 		} `yaml:"api"`
 
 		Blocklist []string `yaml:"blocklist"`
 
+		Drain struct {
+			Enabled bool   `yaml:"enabled"`
+			Message string `yaml:"message"`
+		} `yaml:"drain"`
+
 		Feedback struct {
 			Enabled bool `yaml:"enabled"`
 			Timeout int  `yaml:"timeout"`
@@ -24,21 +40,83 @@ type serverConfig struct {
 			IP    int `yaml:"ip"`
 		} `yaml:"limits"`
 
+		Log struct {
+			Level  string `yaml:"level"`
+			Format string `yaml:"format"`
+		} `yaml:"log"`
+
 		Maintenance struct {
 			Enabled bool   `yaml:"enabled"`
 			Message string `yaml:"message"`
+
+			Windows        []maintenanceWindow `yaml:"windows"`
+			Notice         int                 `yaml:"notice"`
+			MinimumSession int                 `yaml:"minimum_session"`
 		} `yaml:"maintenance"`
 
+		Metrics struct {
+			Address string   `yaml:"address"`
+			Keys    []string `yaml:"keys"`
+		} `yaml:"metrics"`
+
+		Playground struct {
+			Enabled     bool  `yaml:"enabled"`
+			Timeout     int   `yaml:"timeout"`
+			MaxScript   int64 `yaml:"max_script"`
+			MaxOutput   int64 `yaml:"max_output"`
+			CacheSize   int   `yaml:"cache_size"`
+			CacheExpiry int   `yaml:"cache_expiry"`
+
+			Limits struct {
+				Total int `yaml:"total"`
+				IP    int `yaml:"ip"`
+			} `yaml:"limits"`
+		} `yaml:"playground"`
+
 		Proxy struct {
 			Address     string `yaml:"address"`
 			Certificate string `yaml:"certificate"`
 			Key         string `yaml:"key"`
+
+			Mappings []proxyMapping `yaml:"mappings"`
+
+			Limits struct {
+				Session     int `yaml:"session"`
+				Total       int `yaml:"total"`
+				IdleTimeout int `yaml:"idle_timeout"`
+				Timeout     int `yaml:"timeout"`
+			} `yaml:"limits"`
 		} `yaml:"proxy"`
 
+		SSH struct {
+			Address string `yaml:"address"`
+			HostKey string `yaml:"host_key"`
+		} `yaml:"ssh"`
+
+		Scenarios struct {
+			Path         string `yaml:"path"`
+			CheckTimeout int    `yaml:"check_timeout"`
+		} `yaml:"scenarios"`
+
 		Statistics struct {
 			Keys []string `yaml:"keys"`
 		} `yaml:"statistics"`
 
+		Web struct {
+			Address     string `yaml:"address"`
+			Domain      string `yaml:"domain"`
+			Ports       []int  `yaml:"ports"`
+			Bandwidth   int64  `yaml:"bandwidth"`
+			Certificate string `yaml:"certificate"`
+			Key         string `yaml:"key"`
+		} `yaml:"web"`
+
+		Tracing struct {
+			Exporter string `yaml:"exporter"`
+			Endpoint string `yaml:"endpoint"`
+			Path     string `yaml:"path"`
+		} `yaml:"tracing"`
+
 		Terms     string `yaml:"terms"`
 		termsHash string
 	} `yaml:"server"`
@@ -73,6 +151,14 @@ type serverConfig struct {
 
 		Profiles []string `yaml:"profiles"`
 
+		Flavors []instanceFlavor `yaml:"flavors"`
+
+		CloudInit struct {
+			UserData      cloudInitTemplate `yaml:"user_data"`
+			VendorData    cloudInitTemplate `yaml:"vendor_data"`
+			NetworkConfig cloudInitTemplate `yaml:"network_config"`
+		} `yaml:"cloud_init"`
+
 		Limits struct {
 			CPU       int    `yaml:"cpu"`
 			Disk      string `yaml:"disk"`
@@ -86,6 +172,110 @@ type serverConfig struct {
 		ReadyCommand []string `yaml:"ready_command"`
 		Expiry       int      `yaml:"expiry"`
 		ConsoleOnly  bool     `yaml:"console_only"`
-		Network      string   `yaml:"network"`
+		ConsoleMode  string   `yaml:"console_mode"`
+
+		Network        string `yaml:"network"`
+		NetworkTimeout int    `yaml:"network_timeout"`
+
+		ExpiryWarnings []int `yaml:"expiry_warnings"`
+		ExpiryWall     bool  `yaml:"expiry_wall"`
+		IdleTimeout    int   `yaml:"idle_timeout"`
+
+		Probes []readinessProbe `yaml:"probes"`
+		probes []readinessProbe
+
+		Freeze struct {
+			Grace       int  `yaml:"grace"`
+			PauseExpiry bool `yaml:"pause_expiry"`
+		} `yaml:"freeze"`
+
+		Exec struct {
+			Enabled     bool  `yaml:"enabled"`
+			Rate        int64 `yaml:"rate"`
+			Concurrency int   `yaml:"concurrency"`
+			Timeout     int   `yaml:"timeout"`
+			MaxInput    int64 `yaml:"max_input"`
+			MaxOutput   int64 `yaml:"max_output"`
+		} `yaml:"exec"`
+
+		Export struct {
+			Paths   []string `yaml:"paths"`
+			MaxSize int64    `yaml:"max_size"`
+			Path    string   `yaml:"path"`
+			Expiry  int      `yaml:"expiry"`
+			URL     string   `yaml:"url"`
+			Timeout int      `yaml:"timeout"`
+		} `yaml:"export"`
+
+		Files struct {
+			Paths   []string `yaml:"paths"`
+			MaxSize int64    `yaml:"max_size"`
+			Quota   int64    `yaml:"quota"`
+		} `yaml:"files"`
+
+		Snapshots struct {
+			Limit   int   `yaml:"limit"`
+			MaxSize int64 `yaml:"max_size"`
+			Reset   bool  `yaml:"reset"`
+		} `yaml:"snapshots"`
 	} `yaml:"session"`
 }
+
+// proxyMapping maps an SNI name pattern to a port on the session instance.
+type proxyMapping struct {
+	Name       string `yaml:"name"`
+	Port       int    `yaml:"port"`
+	TLS        string `yaml:"tls"`
+	BackendTLS bool   `yaml:"backend_tls"`
+}
+
+// maintenanceWindow is a scheduled period during which the server is in maintenance mode.
+type maintenanceWindow struct {
+	Start   time.Time `yaml:"start"`
+	End     time.Time `yaml:"end"`
+	Message string    `yaml:"message"`
+}
+
+// announcement is a message shown to all users, optionally only for a period of time.
+type announcement struct {
+	Message  string    `yaml:"message"`
+	Severity string    `yaml:"severity"`
+	Start    time.Time `yaml:"start"`
+	End      time.Time `yaml:"end"`
+}
+
+// readinessProbe is a check that must pass before an instance is handed to the user.
+type readinessProbe struct {
+	Type     string   `yaml:"type"`
+	Command  []string `yaml:"command"`
+	Port     int      `yaml:"port"`
+	Path     string   `yaml:"path"`
+	Timeout  int      `yaml:"timeout"`
+	Interval int      `yaml:"interval"`
+}
+
+// cloudInitTemplate is a cloud-init configuration template, either inline or read from a file.
+type cloudInitTemplate struct {
+	Content string `yaml:"content"`
+	File    string `yaml:"file"`
+
+	tpl *template.Template
+}
+
+// instanceFlavor is an alternative instance configuration users can pick, its unset fields come from the main configuration.
+type instanceFlavor struct {
+	Name        string   `yaml:"name"`
+	Description string   `yaml:"description"`
+	Image       string   `yaml:"image"`
+	Type        string   `yaml:"type"`
+	Profiles    []string `yaml:"profiles"`
+	ConsoleMode string   `yaml:"console_mode"`
+
+	// Pointers so a flavor can set 0 to disable snapshots or the size limit.
+	Snapshots struct {
+		Limit   *int   `yaml:"limit"`
+		MaxSize *int64 `yaml:"max_size"`
+	} `yaml:"snapshots"`
+
+	instance string
+}
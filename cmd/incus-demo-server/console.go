@@ -0,0 +1,418 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/lxc/incus/v6/client"
+	"github.com/lxc/incus/v6/shared/api"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// consoleTerminal represents an interactive process running in an instance which one or more clients are attached to.
+type consoleTerminal struct {
+	sessionUUID  string
+	instanceName string
+	mode         string
+	shared       bool
+
+	stdin      *io.PipeWriter
+	disconnect chan bool
+
+	muControl sync.Mutex
+	control   *websocket.Conn
+
+	mu      sync.Mutex
+	clients map[io.ReadWriteCloser]consoleClient
+}
+
+// consoleClient records how a client got attached to a terminal.
+type consoleClient struct {
+	inviteID int64
+
+	// key is chosen by the client to address its terminal in later requests.
+	key string
+}
+
+const (
+	consoleModeExec    = "exec"
+	consoleModeConsole = "console"
+)
+
+var errConsoleNotFound = errors.New("Terminal not found")
+
+// Global variables.
+var (
+	consoleTerminalsLock sync.Mutex
+	consoleTerminals     = map[string][]*consoleTerminal{}
+)
+
+func consoleNew(sessionUUID string, instanceName string, mode string, shared bool) *consoleTerminal {
+	return &consoleTerminal{
+		sessionUUID:  sessionUUID,
+		instanceName: instanceName,
+		mode:         mode,
+		shared:       shared,
+		clients:      map[io.ReadWriteCloser]consoleClient{},
+		disconnect:   make(chan bool),
+	}
+}
+
+// consoleResize resizes the terminal of the session the client with the given key is attached to.
+func consoleResize(sessionUUID string, key string, width int, height int) error {
+	consoleTerminalsLock.Lock()
+	terminals := slices.Clone(consoleTerminals[sessionUUID])
+	consoleTerminalsLock.Unlock()
+
+	for _, t := range terminals {
+		t.mu.Lock()
+		found := false
+		for _, client := range t.clients {
+			if client.key == key {
+				found = true
+				break
+			}
+		}
+		t.mu.Unlock()
+
+		if found {
+			return t.resize(width, height)
+		}
+	}
+
+	return errConsoleNotFound
+}
+
+// consoleCount returns the number of clients attached to terminals.
+func consoleCount() int {
+	consoleTerminalsLock.Lock()
+	defer consoleTerminalsLock.Unlock()
+
+	count := 0
+	for _, terminals := range consoleTerminals {
+		for _, t := range terminals {
+			t.mu.Lock()
+			count += len(t.clients)
+			t.mu.Unlock()
+		}
+	}
+
+	return count
+}
+
+// consoleGetShared returns the most recent shareable terminal for the session (if any).
+func consoleGetShared(sessionUUID string) *consoleTerminal {
+	consoleTerminalsLock.Lock()
+	defer consoleTerminalsLock.Unlock()
+
+	terminals := consoleTerminals[sessionUUID]
+	for i := len(terminals) - 1; i >= 0; i-- {
+		if terminals[i].shared {
+			return terminals[i]
+		}
+	}
+
+	return nil
+}
+
+// consoleDisconnectInvite disconnects all clients that were attached through the given invite.
+func consoleDisconnectInvite(sessionUUID string, inviteID int64) {
+	consoleTerminalsLock.Lock()
+	terminals := slices.Clone(consoleTerminals[sessionUUID])
+	consoleTerminalsLock.Unlock()
+
+	for _, t := range terminals {
+		t.mu.Lock()
+		for client, entry := range t.clients {
+			if entry.inviteID == inviteID {
+				_ = client.Close()
+			}
+		}
+		t.mu.Unlock()
+	}
+}
+
+// consoleAll returns all running terminals.
+func consoleAll() []*consoleTerminal {
+	consoleTerminalsLock.Lock()
+	defer consoleTerminalsLock.Unlock()
+
+	terminals := []*consoleTerminal{}
+	for _, entries := range consoleTerminals {
+		terminals = append(terminals, entries...)
+	}
+
+	return terminals
+}
+
+// consoleMessageCloser is implemented by clients which can be told why they're being disconnected.
+type consoleMessageCloser interface {
+	CloseWithMessage(message string) error
+}
+
+// consoleCloseAll disconnects all clients from all terminals with the provided message.
+func consoleCloseAll(message string) {
+	terminals := consoleAll()
+
+	for _, t := range terminals {
+		t.mu.Lock()
+		for client := range t.clients {
+			closer, ok := client.(consoleMessageCloser)
+			if ok {
+				_ = closer.CloseWithMessage(message)
+				continue
+			}
+
+			_, _ = client.Write([]byte("\r\n" + message + "\r\n"))
+			_ = client.Close()
+		}
+		t.mu.Unlock()
+	}
+}
+
+// consoleBroadcast shows a message on all terminals.
+func consoleBroadcast(message string) {
+	terminals := consoleAll()
+
+	for _, t := range terminals {
+		_, _ = t.Write(consoleFormatNotice(message))
+	}
+}
+
+// consoleNotify shows a message on all terminals of the session.
+func consoleNotify(sessionUUID string, message string) {
+	consoleTerminalsLock.Lock()
+	terminals := slices.Clone(consoleTerminals[sessionUUID])
+	consoleTerminalsLock.Unlock()
+
+	for _, t := range terminals {
+		_, _ = t.Write(consoleFormatNotice(message))
+	}
+}
+
+// consoleFormatNotice highlights a server message so it stands out from the terminal output.
+func consoleFormatNotice(message string) []byte {
+	return []byte("\r\n\x1b[1;33m*** " + message + " ***\x1b[0m\r\n")
+}
+
+// consoleWriteTimeout bounds how long a slow client can hold up the output of a terminal.
+const consoleWriteTimeout = 10 * time.Second
+
+// consoleDeadliner is implemented by clients which support write deadlines.
+type consoleDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+// Write sends the output of the terminal to all attached clients.
+func (t *consoleTerminal) Write(p []byte) (int, error) {
+	activityRecord(t.sessionUUID, 0, int64(len(p)))
+
+	// Don't hold the lock while writing, a slow client would block the others from attaching or leaving.
+	t.mu.Lock()
+	clients := make([]io.ReadWriteCloser, 0, len(t.clients))
+	for client := range t.clients {
+		clients = append(clients, client)
+	}
+
+	t.mu.Unlock()
+
+	for _, client := range clients {
+		deadliner, ok := client.(consoleDeadliner)
+		if ok {
+			_ = deadliner.SetWriteDeadline(time.Now().Add(consoleWriteTimeout))
+		}
+
+		_, err := client.Write(p)
+		if err != nil {
+			_ = client.Close()
+
+			t.mu.Lock()
+			delete(t.clients, client)
+			t.mu.Unlock()
+		}
+	}
+
+	return len(p), nil
+}
+
+func (t *consoleTerminal) add(client io.ReadWriteCloser, inviteID int64, key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.clients[client] = consoleClient{inviteID: inviteID, key: key}
+}
+
+func (t *consoleTerminal) remove(client io.ReadWriteCloser) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.clients, client)
+
+	// Terminate the process once the last client is gone.
+	if len(t.clients) == 0 && t.stdin != nil {
+		_ = t.stdin.Close()
+
+		select {
+		case <-t.disconnect:
+		default:
+			close(t.disconnect)
+		}
+	}
+}
+
+// resize sends a window resize request over the control socket.
+func (t *consoleTerminal) resize(width int, height int) error {
+	t.muControl.Lock()
+	defer t.muControl.Unlock()
+
+	if t.control == nil {
+		return fmt.Errorf("Terminal control isn't available")
+	}
+
+	args := map[string]string{
+		"width":  strconv.Itoa(width),
+		"height": strconv.Itoa(height),
+	}
+
+	if t.mode == consoleModeConsole {
+		return t.control.WriteJSON(api.InstanceConsoleControl{Command: "window-resize", Args: args})
+	}
+
+	return t.control.WriteJSON(api.InstanceExecControl{Command: "window-resize", Args: args})
+}
+
+// start spawns the process (or attaches to the console) in the instance, clients added before the call will receive all of its output.
+func (t *consoleTerminal) start(width int, height int) error {
+	inRead, inWrite := io.Pipe()
+	outRead, outWrite := io.Pipe()
+	t.stdin = inWrite
+
+	// Output handler.
+	go io.Copy(t, outRead)
+
+	// Control socket handler.
+	handler := func(conn *websocket.Conn) {
+		t.muControl.Lock()
+		t.control = conn
+		t.muControl.Unlock()
+
+		for {
+			_, _, err := conn.ReadMessage()
+			if err != nil {
+				break
+			}
+		}
+
+		t.muControl.Lock()
+		t.control = nil
+		t.muControl.Unlock()
+	}
+
+	var op incus.Operation
+	var dataDone chan bool
+	var err error
+
+	ctx, span := tracer.Start(context.Background(), "console", trace.WithAttributes(traceSession.String(t.sessionUUID), traceInstance.String(t.instanceName), attribute.String("console.mode", t.mode)))
+	d := incusWithContext(incusDaemon, ctx)
+
+	if t.mode == consoleModeConsole {
+		// Attach to the instance console.
+		req := api.InstanceConsolePost{
+			Width:  width,
+			Height: height,
+			Type:   "console",
+		}
+
+		consoleArgs := incus.InstanceConsoleArgs{
+			Terminal:          &consoleRWC{Reader: inRead, Writer: outWrite},
+			Control:           handler,
+			ConsoleDisconnect: t.disconnect,
+		}
+
+		op, err = d.ConsoleInstance(t.instanceName, req, &consoleArgs)
+		if err != nil {
+			traceEnd(span, err)
+			return err
+		}
+	} else {
+		// Connect to the instance.
+		env := make(map[string]string)
+		env["USER"] = "root"
+		env["HOME"] = "/root"
+		env["TERM"] = "xterm"
+
+		// Send the exec request.
+		req := api.InstanceExecPost{
+			Command:     config.Session.Command,
+			WaitForWS:   true,
+			Interactive: true,
+			Environment: env,
+			Width:       width,
+			Height:      height,
+		}
+
+		execArgs := incus.InstanceExecArgs{
+			Stdin:    inRead,
+			Stdout:   outWrite,
+			Stderr:   outWrite,
+			Control:  handler,
+			DataDone: make(chan bool),
+		}
+
+		op, err = d.ExecInstance(t.instanceName, req, &execArgs)
+		if err != nil {
+			traceEnd(span, err)
+			return err
+		}
+
+		dataDone = execArgs.DataDone
+	}
+
+	consoleTerminalsLock.Lock()
+	consoleTerminals[t.sessionUUID] = append(consoleTerminals[t.sessionUUID], t)
+	consoleTerminalsLock.Unlock()
+
+	go func() {
+		defer span.End()
+
+		_ = op.Wait()
+		if dataDone != nil {
+			<-dataDone
+		}
+
+		inWrite.Close()
+		outWrite.Close()
+
+		// Unregister the terminal.
+		consoleTerminalsLock.Lock()
+		consoleTerminals[t.sessionUUID] = slices.DeleteFunc(consoleTerminals[t.sessionUUID], func(entry *consoleTerminal) bool { return entry == t })
+		if len(consoleTerminals[t.sessionUUID]) == 0 {
+			delete(consoleTerminals, t.sessionUUID)
+		}
+		consoleTerminalsLock.Unlock()
+
+		// Disconnect all remaining clients.
+		t.mu.Lock()
+		for client := range t.clients {
+			_ = client.Close()
+		}
+		t.mu.Unlock()
+	}()
+
+	return nil
+}
+
+// attach forwards the client input to the terminal until the client goes away.
+func (t *consoleTerminal) attach(client io.ReadWriteCloser) {
+	defer t.remove(client)
+
+	_, _ = io.Copy(t.stdin, &activityReader{Reader: client, sessionUUID: t.sessionUUID})
+}
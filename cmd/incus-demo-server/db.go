@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"fmt"
 	"net"
+	"strings"
 	"time"
 
 	"github.com/mattn/go-sqlite3"
@@ -25,11 +26,72 @@ func dbSetup() error {
 		return err
 	}
 
+	err = dbUpdateSchema()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// dbUpdates is the list of schema changes applied on top of the initial tables, in order.
+var dbUpdates = []string{
+	`ALTER TABLE sessions ADD COLUMN files_uploaded INTEGER NOT NULL DEFAULT 0;`,
+	`ALTER TABLE sessions ADD COLUMN proxy_bytes_in INTEGER NOT NULL DEFAULT 0;`,
+	`ALTER TABLE sessions ADD COLUMN proxy_bytes_out INTEGER NOT NULL DEFAULT 0;`,
+	`ALTER TABLE sessions ADD COLUMN end_reason TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE sessions ADD COLUMN frozen_at INTEGER NOT NULL DEFAULT 0;`,
+	`ALTER TABLE sessions ADD COLUMN export_email TEXT NOT NULL DEFAULT '';`,
+	`
+CREATE TABLE IF NOT EXISTS exports (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    session_id INTEGER NOT NULL,
+    token VARCHAR(36) NOT NULL,
+    size INTEGER NOT NULL,
+    creation_date INT NOT NULL,
+    expiry INT NOT NULL,
+    FOREIGN KEY (session_id) REFERENCES sessions (id) ON DELETE CASCADE
+);`,
+	`ALTER TABLE sessions ADD COLUMN scenario TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE sessions ADD COLUMN scenario_step INTEGER NOT NULL DEFAULT 0;`,
+	`
+CREATE TABLE IF NOT EXISTS scenario_steps (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    session_id INTEGER NOT NULL,
+    scenario TEXT NOT NULL,
+    step INTEGER NOT NULL,
+    completion_date INT NOT NULL,
+    UNIQUE (session_id, scenario, step),
+    FOREIGN KEY (session_id) REFERENCES sessions (id) ON DELETE CASCADE
+);`,
+	`ALTER TABLE sessions ADD COLUMN flavor TEXT NOT NULL DEFAULT '';`,
+}
+
+func dbUpdateSchema() error {
+	var version int
+
+	err := dbQueryRow("PRAGMA user_version;").Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	for i := version; i < len(dbUpdates); i++ {
+		_, err = dbExec(dbUpdates[i])
+		if err != nil {
+			return fmt.Errorf("Failed to apply schema update %d: %w", i+1, err)
+		}
+
+		_, err = dbExec(fmt.Sprintf("PRAGMA user_version=%d;", i+1))
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
 func dbCreateTables() error {
-	_, err := db.Exec(`
+	_, err := dbExec(`
 CREATE TABLE IF NOT EXISTS sessions (
     id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
     uuid VARCHAR(36) NOT NULL,
@@ -53,6 +115,44 @@ CREATE TABLE IF NOT EXISTS feedback (
     feedback TEXT,
     FOREIGN KEY (session_id) REFERENCES sessions (id) ON DELETE CASCADE
 );
+
+CREATE TABLE IF NOT EXISTS invites (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    session_id INTEGER NOT NULL,
+    token VARCHAR(36) NOT NULL,
+    mode VARCHAR(16) NOT NULL,
+    creation_date INT NOT NULL,
+    revoked INTEGER NOT NULL DEFAULT 0,
+    FOREIGN KEY (session_id) REFERENCES sessions (id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS guests (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    session_id INTEGER NOT NULL,
+    invite_id INTEGER NOT NULL,
+    request_date INT NOT NULL,
+    request_ip VARCHAR(39) NOT NULL,
+    request_terms VARCHAR(64) NOT NULL,
+    FOREIGN KEY (session_id) REFERENCES sessions (id) ON DELETE CASCADE,
+    FOREIGN KEY (invite_id) REFERENCES invites (id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS remotes (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    session_id INTEGER NOT NULL,
+    fingerprint VARCHAR(64) NOT NULL,
+    certificate TEXT NOT NULL,
+    key TEXT NOT NULL,
+    FOREIGN KEY (session_id) REFERENCES sessions (id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS ssh_credentials (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    session_id INTEGER NOT NULL,
+    type VARCHAR(16) NOT NULL,
+    value TEXT NOT NULL,
+    FOREIGN KEY (session_id) REFERENCES sessions (id) ON DELETE CASCADE
+);
 `)
 	if err != nil {
 		return err
@@ -61,7 +161,7 @@ CREATE TABLE IF NOT EXISTS feedback (
 	return nil
 }
 
-func dbGetStats(period string, unique bool, network *net.IPNet) (int64, error) {
+func dbGetStats(period string, state string, unique bool, network *net.IPNet) (int64, error) {
 	var count int64
 
 	// Deal with unique filter.
@@ -70,29 +170,41 @@ func dbGetStats(period string, unique bool, network *net.IPNet) (int64, error) {
 		what = "distinct request_ip"
 	}
 
-	// Deal with period filter.
-	where := ""
+	// Deal with period filter (playground runs aren't sessions).
+	filters := []string{"status!=3"}
 	if period == "current" {
-		where = "WHERE status=0"
+		filters = append(filters, "status=0")
 	} else if period == "hour" {
 		creation := time.Now().Add(-time.Hour).Unix()
-		where = fmt.Sprintf("WHERE request_date > %d", creation)
+		filters = append(filters, fmt.Sprintf("request_date > %d", creation))
 	} else if period == "day" {
 		creation := time.Now().Add(-time.Hour * 24).Unix()
-		where = fmt.Sprintf("WHERE request_date > %d", creation)
+		filters = append(filters, fmt.Sprintf("request_date > %d", creation))
 	} else if period == "week" {
 		creation := time.Now().Add(-time.Hour * 24 * 7).Unix()
-		where = fmt.Sprintf("WHERE request_date > %d", creation)
+		filters = append(filters, fmt.Sprintf("request_date > %d", creation))
 	} else if period == "month" {
 		creation := time.Now().Add(-time.Hour * time.Duration(24*30.5)).Unix()
-		where = fmt.Sprintf("WHERE request_date > %d", creation)
+		filters = append(filters, fmt.Sprintf("request_date > %d", creation))
 	} else if period == "year" {
 		creation := time.Now().Add(-time.Hour * time.Duration(24*365.25)).Unix()
-		where = fmt.Sprintf("WHERE request_date > %d", creation)
+		filters = append(filters, fmt.Sprintf("request_date > %d", creation))
+	}
+
+	// Deal with state filter (only active sessions have one).
+	if state == "frozen" {
+		filters = append(filters, "status=0 AND frozen_at>0")
+	} else if state == "running" {
+		filters = append(filters, "status=0 AND frozen_at=0")
+	}
+
+	where := ""
+	if len(filters) > 0 {
+		where = "WHERE " + strings.Join(filters, " AND ")
 	}
 
 	if network == nil {
-		err := db.QueryRow(fmt.Sprintf("SELECT count(%s) FROM sessions %s;", what, where)).Scan(&count)
+		err := dbQueryRow(fmt.Sprintf("SELECT count(%s) FROM sessions %s;", what, where)).Scan(&count)
 		if err != nil {
 			return -1, err
 		}
@@ -125,8 +237,8 @@ func dbGetStats(period string, unique bool, network *net.IPNet) (int64, error) {
 func dbShouldExist(name string) (bool, error) {
 	var count int64
 
-	statement := `SELECT COUNT(id) FROM sessions WHERE instance_name=? AND status IN (0, 2);`
-	err := db.QueryRow(statement, name).Scan(&count)
+	statement := `SELECT COUNT(id) FROM sessions WHERE instance_name=? AND status IN (0, 2, 3);`
+	err := dbQueryRow(statement, name).Scan(&count)
 	if err != nil {
 		return false, err
 	}
@@ -135,11 +247,12 @@ func dbShouldExist(name string) (bool, error) {
 }
 
 func dbActive() ([][]interface{}, error) {
-	q := fmt.Sprintf("SELECT id, instance_name, instance_expiry FROM sessions WHERE status=0;")
+	q := fmt.Sprintf("SELECT id, instance_name, instance_expiry, uuid FROM sessions WHERE status=0;")
 	var instanceID int
 	var instanceName string
 	var instanceExpiry int
-	outfmt := []interface{}{instanceID, instanceName, instanceExpiry}
+	var instanceUUID string
+	outfmt := []interface{}{instanceID, instanceName, instanceExpiry, instanceUUID}
 	result, err := dbQueryScan(db, q, nil, outfmt)
 	if err != nil {
 		return nil, err
@@ -217,7 +330,7 @@ func dbGetFeedback(id int64) (int64, int64, string, int64, string, error) {
 }
 
 func dbNew(status int, id string, instanceName string, instanceIP string, instanceUsername string, instancePassword string, instanceExpiry int64, requestDate int64, requestIP string, requestTerms string) (int64, error) {
-	res, err := db.Exec(`
+	res, err := dbExec(`
 INSERT INTO sessions (
 	status,
 	uuid,
@@ -251,7 +364,7 @@ func dbRecordFeedback(id int64, feedback Feedback) error {
 
 	if feedbackId == -1 {
 		// Record new feedback.
-		_, err := db.Exec(`
+		_, err := dbExec(`
 INSERT INTO feedback (
 	session_id,
 	rating,
@@ -267,7 +380,7 @@ INSERT INTO feedback (
 	}
 
 	// Update existing feedback.
-	_, err = db.Exec(`
+	_, err = dbExec(`
 UPDATE feedback SET rating=?, email=?, email_use=?, feedback=? WHERE session_id=?;
 `, feedback.Rating, feedback.Email, feedback.EmailUse, feedback.Message, id)
 	if err != nil {
@@ -277,21 +390,212 @@ UPDATE feedback SET rating=?, email=?, email_use=?, feedback=? WHERE session_id=
 	return nil
 }
 
-func dbDelete(id int64) error {
-	_, err := db.Exec("DELETE FROM sessions WHERE id=?;", id)
+func dbNewInvite(sessionID int64, token string, mode string) (int64, error) {
+	res, err := dbExec(`
+INSERT INTO invites (
+	session_id,
+	token,
+	mode,
+	creation_date) VALUES (?, ?, ?, ?);
+`, sessionID, token, mode, time.Now().Unix())
+	if err != nil {
+		return 0, err
+	}
+
+	inviteID, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return inviteID, nil
+}
+
+func dbGetInvite(token string) (int64, int64, string, string, string, error) {
+	var inviteID int64
+	var sessionID int64
+	var sessionUUID string
+	var instanceName string
+	var mode string
+
+	inviteID = -1
+	rows, err := dbQuery(db, "SELECT invites.id, sessions.id, sessions.uuid, sessions.instance_name, invites.mode FROM invites JOIN sessions ON sessions.id=invites.session_id WHERE invites.token=? AND invites.revoked=0 AND sessions.status=0;", token)
+	if err != nil {
+		return -1, -1, "", "", "", err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		rows.Scan(&inviteID, &sessionID, &sessionUUID, &instanceName, &mode)
+	}
+
+	return inviteID, sessionID, sessionUUID, instanceName, mode, nil
+}
+
+func dbGetInvites(sessionID int64) ([][]interface{}, error) {
+	q := "SELECT id, token, mode, creation_date, revoked FROM invites WHERE session_id=?;"
+	var inviteID int
+	var token string
+	var mode string
+	var creationDate int
+	var revoked int
+	outfmt := []interface{}{inviteID, token, mode, creationDate, revoked}
+	result, err := dbQueryScan(db, q, []interface{}{sessionID}, outfmt)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func dbGetGuests(inviteID int64) ([][]interface{}, error) {
+	q := "SELECT request_date, request_ip FROM guests WHERE invite_id=?;"
+	var requestDate int
+	var requestIP string
+	outfmt := []interface{}{requestDate, requestIP}
+	result, err := dbQueryScan(db, q, []interface{}{inviteID}, outfmt)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func dbRevokeInvite(sessionID int64, token string) (int64, error) {
+	var inviteID int64
+
+	statement := `SELECT id FROM invites WHERE session_id=? AND token=? AND revoked=0;`
+	err := dbQueryRow(statement, sessionID, token).Scan(&inviteID)
+	if err != nil {
+		return -1, err
+	}
+
+	_, err = dbExec("UPDATE invites SET revoked=1 WHERE id=?;", inviteID)
+	if err != nil {
+		return -1, err
+	}
+
+	return inviteID, nil
+}
+
+func dbRecordGuest(sessionID int64, inviteID int64, requestDate int64, requestIP string, requestTerms string) error {
+	_, err := dbExec(`
+INSERT INTO guests (
+	session_id,
+	invite_id,
+	request_date,
+	request_ip,
+	request_terms) VALUES (?, ?, ?, ?, ?);
+`, sessionID, inviteID, requestDate, requestIP, requestTerms)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func dbAddProxyBytes(id int64, bytesIn int64, bytesOut int64) error {
+	_, err := dbExec("UPDATE sessions SET proxy_bytes_in=proxy_bytes_in+?, proxy_bytes_out=proxy_bytes_out+? WHERE id=?;", bytesIn, bytesOut, id)
 	return err
 }
 
-func dbExpire(id int64) error {
-	_, err := db.Exec("UPDATE sessions SET status=1 WHERE id=?;", id)
+func dbNewRemote(sessionID int64, fingerprint string, certificate string, key string) error {
+	_, err := dbExec(`
+INSERT INTO remotes (
+	session_id,
+	fingerprint,
+	certificate,
+	key) VALUES (?, ?, ?, ?);
+`, sessionID, fingerprint, certificate, key)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func dbGetRemote(sessionID int64, fingerprint string) (string, string, error) {
+	var certificate string
+	var key string
+
+	statement := `SELECT certificate, key FROM remotes WHERE session_id=? AND fingerprint=?;`
+	err := dbQueryRow(statement, sessionID, fingerprint).Scan(&certificate, &key)
+	if err != nil {
+		return "", "", err
+	}
+
+	return certificate, key, nil
+}
+
+func dbGetSSHCredentials(sessionID int64) ([][]interface{}, error) {
+	q := "SELECT type, value FROM ssh_credentials WHERE session_id=?;"
+	var credType string
+	var value string
+	outfmt := []interface{}{credType, value}
+	result, err := dbQueryScan(db, q, []interface{}{sessionID}, outfmt)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func dbNewSSHCredential(sessionID int64, credType string, value string) error {
+	_, err := dbExec(`
+INSERT INTO ssh_credentials (
+	session_id,
+	type,
+	value) VALUES (?, ?, ?);
+`, sessionID, credType, value)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func dbGetFilesUploaded(id int64) (int64, error) {
+	var uploaded int64
+
+	statement := `SELECT files_uploaded FROM sessions WHERE id=?;`
+	err := dbQueryRow(statement, id).Scan(&uploaded)
+	if err != nil {
+		return 0, err
+	}
+
+	return uploaded, nil
+}
+
+func dbAddFilesUploaded(id int64, size int64) error {
+	_, err := dbExec("UPDATE sessions SET files_uploaded=files_uploaded+? WHERE id=?;", size, id)
 	return err
 }
 
+func dbDelete(id int64) error {
+	_, err := dbExec("DELETE FROM sessions WHERE id=?;", id)
+	return err
+}
+
+// dbExpire marks an active session as ended, returning false if it had already ended.
+func dbExpire(id int64, reason string) (bool, error) {
+	result, err := dbExec("UPDATE sessions SET status=1, end_reason=? WHERE id=? AND status=0;", reason, id)
+	if err != nil {
+		return false, err
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
 func dbIsAllocated(id int64) bool {
 	var count int
 
 	statement := `SELECT COUNT(id) FROM sessions WHERE status=2 AND id=?;`
-	err := db.QueryRow(statement, id).Scan(&count)
+	err := dbQueryRow(statement, id).Scan(&count)
 	if err != nil {
 		return false
 	}
@@ -299,7 +603,38 @@ func dbIsAllocated(id int64) bool {
 	return count == 1
 }
 
-func dbGetAllocated(instanceExpiry int64, requestDate int64, requestIP string, requestTerms string) (int64, string, string, string, string, string, error) {
+// dbClaimAllocated takes the oldest pre-allocated instance for a playground run.
+// The record is turned into a playground one (status 3) so it's neither an active session nor a pool entry.
+func dbClaimAllocated(flavor string, instanceExpiry int64) (int64, string, error) {
+	var id int64
+	var instanceName string
+
+	// Check if feature is enabled at all.
+	if config.Instance.Allocate.Count == 0 {
+		return 0, "", fmt.Errorf("Pre-allocated instances isn't enabled")
+	}
+
+	// Pre-allocated instances all use the default flavor.
+	if flavor != "" {
+		return 0, "", fmt.Errorf("No pre-allocated instances for flavor %q", flavor)
+	}
+
+	statement := `UPDATE sessions SET status=3, instance_expiry=? WHERE id=(SELECT id FROM sessions WHERE status=2 ORDER BY instance_expiry ASC LIMIT 1) RETURNING id, instance_name;`
+	err := dbQueryRow(statement, instanceExpiry).Scan(&id, &instanceName)
+	if err != nil {
+		return 0, "", err
+	}
+
+	return id, instanceName, nil
+}
+
+// dbDeletePlaygroundExpired removes the records of playground runs that should have long finished.
+func dbDeletePlaygroundExpired() error {
+	_, err := dbExec("DELETE FROM sessions WHERE status=3 AND instance_expiry<?;", time.Now().Unix())
+	return err
+}
+
+func dbGetAllocated(flavor string, instanceExpiry int64, requestDate int64, requestIP string, requestTerms string) (int64, string, string, string, string, string, error) {
 	var id int64
 	var uuid string
 	var instanceName string
@@ -312,9 +647,14 @@ func dbGetAllocated(instanceExpiry int64, requestDate int64, requestIP string, r
 		return 0, "", "", "", "", "", fmt.Errorf("Pre-allocated instances isn't enabled")
 	}
 
+	// Pre-allocated instances all use the default flavor.
+	if flavor != "" {
+		return 0, "", "", "", "", "", fmt.Errorf("No pre-allocated instances for flavor %q", flavor)
+	}
+
 	// Find oldest pre-allocated instance.
 	statement := `SELECT id, uuid, instance_name, instance_ip, instance_username, instance_password FROM sessions WHERE status=2 ORDER BY instance_expiry ASC LIMIT 1;`
-	err := db.QueryRow(statement, id).Scan(&id, &uuid, &instanceName, &instanceIP, &instanceUsername, &instancePassword)
+	err := dbQueryRow(statement, id).Scan(&id, &uuid, &instanceName, &instanceIP, &instanceUsername, &instancePassword)
 	if err != nil {
 		return 0, "", "", "", "", "", err
 	}
@@ -325,7 +665,7 @@ func dbGetAllocated(instanceExpiry int64, requestDate int64, requestIP string, r
 	}
 
 	// Update the record to match the new request.
-	_, err = db.Exec("UPDATE sessions SET status=0, instance_expiry=?, request_date=?, request_ip=?, request_terms=? WHERE id=?", instanceExpiry, requestDate, requestIP, requestTerms, id)
+	_, err = dbExec("UPDATE sessions SET status=0, instance_expiry=?, request_date=?, request_ip=?, request_terms=? WHERE id=?", instanceExpiry, requestDate, requestIP, requestTerms, id)
 	if err != nil {
 		return 0, "", "", "", "", "", err
 	}
@@ -337,7 +677,7 @@ func dbActiveCount() (int, error) {
 	var count int
 
 	statement := `SELECT count(*) FROM sessions WHERE status=0;`
-	err := db.QueryRow(statement).Scan(&count)
+	err := dbQueryRow(statement).Scan(&count)
 	if err != nil {
 		return 0, err
 	}
@@ -349,7 +689,7 @@ func dbActiveCountForIP(ip string) (int, error) {
 	var count int
 
 	statement := `SELECT count(*) FROM sessions WHERE status=0 AND request_ip=?;`
-	err := db.QueryRow(statement, ip).Scan(&count)
+	err := dbQueryRow(statement, ip).Scan(&count)
 	if err != nil {
 		return 0, err
 	}
@@ -361,7 +701,7 @@ func dbNextExpire() (int, error) {
 	var expire int
 
 	statement := `SELECT MIN(instance_expiry) FROM sessions WHERE status=0;`
-	err := db.QueryRow(statement).Scan(&expire)
+	err := dbQueryRow(statement).Scan(&expire)
 	if err != nil {
 		return 0, err
 	}
@@ -369,6 +709,241 @@ func dbNextExpire() (int, error) {
 	return expire, nil
 }
 
+// dbGetFrozen returns when the session was frozen (0 if it isn't).
+func dbGetFrozen(id int64) (int64, error) {
+	var frozenAt int64
+
+	err := dbQueryRow("SELECT frozen_at FROM sessions WHERE id=?;", id).Scan(&frozenAt)
+	if err != nil {
+		return 0, err
+	}
+
+	return frozenAt, nil
+}
+
+func dbSetFrozen(id int64, frozenAt int64) error {
+	_, err := dbExec("UPDATE sessions SET frozen_at=? WHERE id=?;", frozenAt, id)
+	return err
+}
+
+// dbExtendExpiry pushes the expiry of the session back, returning the new expiry.
+func dbExtendExpiry(id int64, seconds int64) (int64, error) {
+	var expiry int64
+
+	_, err := dbExec("UPDATE sessions SET instance_expiry=instance_expiry+? WHERE id=?;", seconds, id)
+	if err != nil {
+		return 0, err
+	}
+
+	err = dbQueryRow("SELECT instance_expiry FROM sessions WHERE id=?;", id).Scan(&expiry)
+	if err != nil {
+		return 0, err
+	}
+
+	return expiry, nil
+}
+
+func dbGetExportEmail(id int64) (string, error) {
+	var email string
+
+	err := dbQueryRow("SELECT export_email FROM sessions WHERE id=?;", id).Scan(&email)
+	if err != nil {
+		return "", err
+	}
+
+	return email, nil
+}
+
+func dbSetExportEmail(id int64, email string) error {
+	_, err := dbExec("UPDATE sessions SET export_email=? WHERE id=?;", email, id)
+	return err
+}
+
+func dbNewExport(sessionID int64, token string, size int64, expiry int64) error {
+	_, err := dbExec(`
+INSERT INTO exports (
+	session_id,
+	token,
+	size,
+	creation_date,
+	expiry) VALUES (?, ?, ?, ?, ?);
+`, sessionID, token, size, time.Now().Unix(), expiry)
+
+	return err
+}
+
+// dbGetExport returns the session and expiry of an export (session -1 if not found).
+func dbGetExport(token string) (int64, int64, error) {
+	var sessionID int64
+	var expiry int64
+
+	err := dbQueryRow("SELECT session_id, expiry FROM exports WHERE token=?;", token).Scan(&sessionID, &expiry)
+	if err != nil {
+		if dbIsNoMatchError(err) {
+			return -1, 0, nil
+		}
+
+		return -1, 0, err
+	}
+
+	return sessionID, expiry, nil
+}
+
+// dbGetExpiredExports returns the tokens of the exports whose link has expired.
+func dbGetExpiredExports() ([][]interface{}, error) {
+	q := "SELECT token FROM exports WHERE expiry<?;"
+	var token string
+	outfmt := []interface{}{token}
+	result, err := dbQueryScan(db, q, []interface{}{time.Now().Unix()}, outfmt)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// dbGetSessionExports returns the tokens of all the exports of a session.
+func dbGetSessionExports(sessionID int64) ([][]interface{}, error) {
+	q := "SELECT token FROM exports WHERE session_id=?;"
+	var token string
+	outfmt := []interface{}{token}
+	result, err := dbQueryScan(db, q, []interface{}{sessionID}, outfmt)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func dbDeleteExport(token string) error {
+	_, err := dbExec("DELETE FROM exports WHERE token=?;", token)
+	return err
+}
+
+// dbGetFlavor returns the flavor of the session (empty for the default one).
+func dbGetFlavor(id int64) (string, error) {
+	var flavor string
+
+	err := dbQueryRow("SELECT flavor FROM sessions WHERE id=?;", id).Scan(&flavor)
+	if err != nil {
+		return "", err
+	}
+
+	return flavor, nil
+}
+
+func dbSetFlavor(id int64, flavor string) error {
+	_, err := dbExec("UPDATE sessions SET flavor=? WHERE id=?;", flavor, id)
+	return err
+}
+
+// dbGetScenario returns the scenario of the session and the index of its current step.
+func dbGetScenario(id int64) (string, int, error) {
+	var name string
+	var step int
+
+	err := dbQueryRow("SELECT scenario, scenario_step FROM sessions WHERE id=?;", id).Scan(&name, &step)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return name, step, nil
+}
+
+func dbSetScenario(id int64, name string) error {
+	_, err := dbExec("UPDATE sessions SET scenario=?, scenario_step=0 WHERE id=?;", name, id)
+	return err
+}
+
+func dbSetScenarioStep(id int64, step int) error {
+	_, err := dbExec("UPDATE sessions SET scenario_step=? WHERE id=?;", step, id)
+	return err
+}
+
+// dbCompleteScenarioStep records the completion of a step, keeping the first completion date.
+func dbCompleteScenarioStep(sessionID int64, name string, step int) error {
+	_, err := dbExec(`
+INSERT OR IGNORE INTO scenario_steps (
+	session_id,
+	scenario,
+	step,
+	completion_date) VALUES (?, ?, ?, ?);
+`, sessionID, name, step, time.Now().Unix())
+
+	return err
+}
+
+// dbGetScenarioSteps returns the completed steps of the session and when they were completed.
+func dbGetScenarioSteps(sessionID int64, name string) ([][]interface{}, error) {
+	q := "SELECT step, completion_date FROM scenario_steps WHERE session_id=? AND scenario=? ORDER BY step;"
+	var step int
+	var completionDate int
+	outfmt := []interface{}{step, completionDate}
+	result, err := dbQueryScan(db, q, []interface{}{sessionID, name}, outfmt)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// dbGetScenarioFunnel returns how many sessions started the scenario and how many completed each step.
+func dbGetScenarioFunnel(name string) (int, map[int]int, error) {
+	var started int
+
+	err := dbQueryRow("SELECT count(*) FROM sessions WHERE scenario=?;", name).Scan(&started)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	q := "SELECT step, count(DISTINCT session_id) FROM scenario_steps WHERE scenario=? GROUP BY step;"
+	var step int
+	var count int
+	outfmt := []interface{}{step, count}
+	result, err := dbQueryScan(db, q, []interface{}{name}, outfmt)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	completed := map[int]int{}
+	for _, entry := range result {
+		completed[entry[0].(int)] = entry[1].(int)
+	}
+
+	return started, completed, nil
+}
+
+// dbCheckWritable makes sure the database can still be written to, without changing anything.
+func dbCheckWritable() error {
+	// Re-writing the schema version is the cheapest write possible.
+	var version int
+	err := dbQueryRow(`PRAGMA user_version;`).Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	_, err = dbExec(fmt.Sprintf(`PRAGMA user_version=%d;`, version))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// dbExec runs a statement, recording its latency.
+func dbExec(q string, args ...interface{}) (sql.Result, error) {
+	defer metricDBDuration.observeSince("", time.Now())
+
+	return db.Exec(q, args...)
+}
+
+// dbQueryRow runs a single row query, recording its latency.
+func dbQueryRow(q string, args ...interface{}) *sql.Row {
+	defer metricDBDuration.observeSince("", time.Now())
+
+	return db.QueryRow(q, args...)
+}
+
 func dbIsLockedError(err error) bool {
 	if err == nil {
 		return false
@@ -409,6 +984,8 @@ func dbQueryRowScan(db *sql.DB, q string, args []interface{}, outargs []interfac
 }
 
 func dbQuery(db *sql.DB, q string, args ...interface{}) (*sql.Rows, error) {
+	defer metricDBDuration.observeSince("", time.Now())
+
 	for {
 		result, err := db.Query(q, args...)
 		if err == nil {
@@ -467,6 +1044,8 @@ func dbDoQueryScan(db *sql.DB, q string, args []interface{}, outargs []interface
 }
 
 func dbQueryScan(db *sql.DB, q string, inargs []interface{}, outfmt []interface{}) ([][]interface{}, error) {
+	defer metricDBDuration.observeSince("", time.Now())
+
 	for {
 		result, err := dbDoQueryScan(db, q, inargs, outfmt)
 		if err == nil {
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Global variables.
+var (
+	eventListenersLock sync.Mutex
+	eventListeners     = map[string][]*eventListener{}
+)
+
+// eventListener is a client websocket subscribed to the events of a session.
+type eventListener struct {
+	mu   sync.Mutex
+	conn *websocket.Conn
+}
+
+// eventSend delivers a structured event to all listeners of the session.
+func eventSend(sessionUUID string, eventType string, metadata map[string]any) {
+	eventListenersLock.Lock()
+	listeners := slices.Clone(eventListeners[sessionUUID])
+	eventListenersLock.Unlock()
+
+	event := map[string]any{
+		"type":      eventType,
+		"timestamp": time.Now().Unix(),
+		"metadata":  metadata,
+	}
+
+	for _, listener := range listeners {
+		listener.mu.Lock()
+		_ = listener.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		err := listener.conn.WriteJSON(event)
+		listener.mu.Unlock()
+
+		if err != nil {
+			_ = listener.conn.Close()
+		}
+	}
+}
+
+func restEventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Not implemented", 501)
+		return
+	}
+
+	if maintenanceEnabled() || incusDaemon == nil {
+		http.Error(w, "Server in maintenance mode", 500)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	// Get the id argument.
+	id := r.FormValue("id")
+	if id == "" {
+		http.Error(w, "Missing session id", 400)
+		return
+	}
+
+	// Get the instance.
+	sessionId, _, _, _, _, _, err := dbGetInstance(id, true)
+	if err != nil || sessionId == -1 {
+		http.Error(w, "Session not found", 404)
+		return
+	}
+
+	// Setup websocket with the client.
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin: func(r *http.Request) bool {
+			return true
+		},
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+	defer conn.Close()
+
+	// Register the listener.
+	listener := &eventListener{conn: conn}
+
+	eventListenersLock.Lock()
+	eventListeners[id] = append(eventListeners[id], listener)
+	eventListenersLock.Unlock()
+
+	defer func() {
+		eventListenersLock.Lock()
+		eventListeners[id] = slices.DeleteFunc(eventListeners[id], func(entry *eventListener) bool { return entry == listener })
+		if len(eventListeners[id]) == 0 {
+			delete(eventListeners, id)
+		}
+		eventListenersLock.Unlock()
+	}()
+
+	// Wait for the client to go away.
+	for {
+		_, _, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+	}
+}
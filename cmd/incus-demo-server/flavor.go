@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+)
+
+var flavorNameRegex = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]*$`)
+
+// flavorGet returns the named flavor with its unset fields taken from the main configuration (nil if it doesn't exist).
+// The empty name is the default flavor, made of the main configuration alone.
+func flavorGet(name string) *instanceFlavor {
+	flavor := instanceFlavor{
+		Image:       config.Instance.Source.Image,
+		Type:        config.Instance.Source.InstanceType,
+		Profiles:    config.Instance.Profiles,
+		ConsoleMode: config.Session.ConsoleMode,
+		instance:    config.Instance.Source.Instance,
+	}
+
+	limit := config.Session.Snapshots.Limit
+	maxSize := config.Session.Snapshots.MaxSize
+	flavor.Snapshots.Limit = &limit
+	flavor.Snapshots.MaxSize = &maxSize
+
+	if name == "" {
+		return &flavor
+	}
+
+	for _, entry := range config.Instance.Flavors {
+		if entry.Name != name {
+			continue
+		}
+
+		flavor.Name = entry.Name
+		flavor.Description = entry.Description
+
+		// An image replaces the instance to copy.
+		if entry.Image != "" {
+			flavor.Image = entry.Image
+			flavor.instance = ""
+		}
+
+		if entry.Type != "" {
+			flavor.Type = entry.Type
+		}
+
+		if entry.Profiles != nil {
+			flavor.Profiles = entry.Profiles
+		}
+
+		if entry.ConsoleMode != "" {
+			flavor.ConsoleMode = entry.ConsoleMode
+		}
+
+		if entry.Snapshots.Limit != nil {
+			limit = *entry.Snapshots.Limit
+		}
+
+		if entry.Snapshots.MaxSize != nil {
+			maxSize = *entry.Snapshots.MaxSize
+		}
+
+		return &flavor
+	}
+
+	return nil
+}
+
+// flavorSession returns the flavor of the session, falling back to the default one if it was removed since.
+func flavorSession(sessionID int64) (*instanceFlavor, error) {
+	name, err := dbGetFlavor(sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	flavor := flavorGet(name)
+	if flavor == nil {
+		flavor = flavorGet("")
+	}
+
+	return flavor, nil
+}
+
+// flavorValidate checks the flavors defined in the configuration.
+func flavorValidate() error {
+	names := []string{}
+
+	for _, entry := range config.Instance.Flavors {
+		if !flavorNameRegex.MatchString(entry.Name) {
+			return fmt.Errorf("Invalid flavor name %q", entry.Name)
+		}
+
+		if slices.Contains(names, entry.Name) {
+			return fmt.Errorf("Duplicate flavor %q", entry.Name)
+		}
+
+		names = append(names, entry.Name)
+
+		if entry.Type != "" && !slices.Contains([]string{"container", "virtual-machine"}, entry.Type) {
+			return fmt.Errorf("Invalid instance type %q for flavor %q", entry.Type, entry.Name)
+		}
+
+		if entry.Type != "" && entry.Image == "" && config.Instance.Source.Instance != "" {
+			return fmt.Errorf("Flavor %q can only change the instance type along with the image", entry.Name)
+		}
+
+		if entry.ConsoleMode != "" && !slices.Contains([]string{consoleModeExec, consoleModeConsole}, entry.ConsoleMode) {
+			return fmt.Errorf("Invalid console mode %q for flavor %q", entry.ConsoleMode, entry.Name)
+		}
+
+		if entry.Snapshots.Limit != nil && *entry.Snapshots.Limit < 0 {
+			return fmt.Errorf("Invalid snapshot limit for flavor %q", entry.Name)
+		}
+
+		if entry.Snapshots.MaxSize != nil && *entry.Snapshots.MaxSize < 0 {
+			return fmt.Errorf("Invalid snapshot size limit for flavor %q", entry.Name)
+		}
+	}
+
+	return nil
+}
+
+// flavorList returns the name and description of the flavors users can pick from.
+func flavorList() []map[string]any {
+	flavors := []map[string]any{}
+	for _, entry := range config.Instance.Flavors {
+		flavors = append(flavors, map[string]any{
+			"name":        entry.Name,
+			"description": entry.Description,
+		})
+	}
+
+	return flavors
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/lxc/incus/v6/shared/api"
+)
+
+// muFreeze serializes the freezing and unfreezing of instances.
+var muFreeze sync.Mutex
+
+// sessionFreeze freezes the instance of a session nobody is connected to.
+func sessionFreeze(sessionID int64, sessionUUID string, instanceName string) error {
+	muFreeze.Lock()
+	defer muFreeze.Unlock()
+
+	// Check that nobody connected in the meantime.
+	sessionActivitiesLock.Lock()
+	consoles := activityGet(sessionUUID).consoles
+	sessionActivitiesLock.Unlock()
+
+	if consoles > 0 {
+		return nil
+	}
+
+	frozenAt, err := dbGetFrozen(sessionID)
+	if err != nil {
+		return err
+	}
+
+	if frozenAt > 0 {
+		return nil
+	}
+
+	req := api.InstanceStatePut{
+		Action:  "freeze",
+		Timeout: -1,
+	}
+
+	op, err := incusDaemon.UpdateInstanceState(instanceName, req, "")
+	if err != nil {
+		return err
+	}
+
+	err = op.Wait()
+	if err != nil {
+		return err
+	}
+
+	err = dbSetFrozen(sessionID, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Session frozen", logSession, sessionUUID, logInstance, instanceName)
+
+	return nil
+}
+
+// sessionUnfreeze resumes the instance of a session (if frozen), pushing its expiry back if configured to.
+func sessionUnfreeze(sessionID int64, sessionUUID string, instanceName string) error {
+	muFreeze.Lock()
+	defer muFreeze.Unlock()
+
+	frozenAt, err := dbGetFrozen(sessionID)
+	if err != nil {
+		return err
+	}
+
+	if frozenAt == 0 {
+		return nil
+	}
+
+	req := api.InstanceStatePut{
+		Action:  "unfreeze",
+		Timeout: -1,
+	}
+
+	op, err := incusDaemon.UpdateInstanceState(instanceName, req, "")
+	if err != nil {
+		return err
+	}
+
+	err = op.Wait()
+	if err != nil {
+		return err
+	}
+
+	err = dbSetFrozen(sessionID, 0)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Session unfrozen", logSession, sessionUUID, logInstance, instanceName)
+
+	// Don't count the time spent frozen.
+	if config.Session.Freeze.PauseExpiry {
+		expiry, err := dbExtendExpiry(sessionID, time.Now().Unix()-frozenAt)
+		if err != nil {
+			return err
+		}
+
+		sessionSchedule(sessionID, sessionUUID, instanceName, expiry)
+	}
+
+	return nil
+}
+
+// sessionIsFrozen returns whether the instance of a session is currently frozen.
+func sessionIsFrozen(sessionID int64) bool {
+	frozenAt, err := dbGetFrozen(sessionID)
+	if err != nil {
+		return false
+	}
+
+	return frozenAt > 0
+}
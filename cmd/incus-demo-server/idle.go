@@ -0,0 +1,143 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// sessionActivity tracks the console usage of a session.
+type sessionActivity struct {
+	consoles int
+	bytesIn  int64
+	bytesOut int64
+	lastSeen time.Time
+}
+
+// Global variables.
+var (
+	sessionActivitiesLock sync.Mutex
+	sessionActivities     = map[string]*sessionActivity{}
+)
+
+// activityGet returns the activity record of the session, creating it if needed (must be called with the lock held).
+func activityGet(sessionUUID string) *sessionActivity {
+	activity, ok := sessionActivities[sessionUUID]
+	if !ok {
+		activity = &sessionActivity{lastSeen: time.Now()}
+		sessionActivities[sessionUUID] = activity
+	}
+
+	return activity
+}
+
+// activityConnect records a new console connection.
+func activityConnect(sessionUUID string) {
+	sessionActivitiesLock.Lock()
+	defer sessionActivitiesLock.Unlock()
+
+	activity := activityGet(sessionUUID)
+	activity.consoles++
+	activity.lastSeen = time.Now()
+}
+
+// activityDisconnect records a console going away (ignored once the session is forgotten).
+func activityDisconnect(sessionUUID string) {
+	sessionActivitiesLock.Lock()
+	defer sessionActivitiesLock.Unlock()
+
+	activity, ok := sessionActivities[sessionUUID]
+	if !ok {
+		return
+	}
+
+	activity.consoles--
+	activity.lastSeen = time.Now()
+}
+
+// activityRecord accounts for console traffic (ignored for sessions not being tracked).
+func activityRecord(sessionUUID string, bytesIn int64, bytesOut int64) {
+	sessionActivitiesLock.Lock()
+	defer sessionActivitiesLock.Unlock()
+
+	activity, ok := sessionActivities[sessionUUID]
+	if !ok {
+		return
+	}
+
+	activity.bytesIn += bytesIn
+	activity.bytesOut += bytesOut
+	activity.lastSeen = time.Now()
+}
+
+// activityForget drops the activity record of an ended session.
+func activityForget(sessionUUID string) {
+	sessionActivitiesLock.Lock()
+	defer sessionActivitiesLock.Unlock()
+
+	delete(sessionActivities, sessionUUID)
+}
+
+// activityReader records the input sent by a console client.
+type activityReader struct {
+	io.Reader
+
+	sessionUUID string
+}
+
+func (r *activityReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		activityRecord(r.sessionUUID, int64(n), 0)
+	}
+
+	return n, err
+}
+
+// idleMonitor freezes or reclaims the sessions which have had no console attached for a while.
+func idleMonitor() {
+	for {
+		time.Sleep(30 * time.Second)
+
+		if (config.Session.IdleTimeout <= 0 && config.Session.Freeze.Grace <= 0) || incusDaemon == nil {
+			continue
+		}
+
+		instances, err := dbActive()
+		if err != nil {
+			slog.Error("Unable to read current instances", logError, err)
+			continue
+		}
+
+		for _, entry := range instances {
+			instanceID := int64(entry[0].(int))
+			instanceName := entry[1].(string)
+			instanceUUID := entry[3].(string)
+
+			sessionActivitiesLock.Lock()
+			activity := activityGet(instanceUUID)
+			idle := time.Duration(0)
+			if activity.consoles <= 0 {
+				idle = time.Since(activity.lastSeen)
+			}
+			sessionActivitiesLock.Unlock()
+
+			if idle == 0 {
+				continue
+			}
+
+			if config.Session.IdleTimeout > 0 && idle >= time.Duration(config.Session.IdleTimeout)*time.Second {
+				sessionEnd(instanceID, instanceUUID, instanceName, sessionEndIdle)
+				continue
+			}
+
+			if config.Session.Freeze.Grace > 0 && idle >= time.Duration(config.Session.Freeze.Grace)*time.Second {
+				err := sessionFreeze(instanceID, instanceUUID, instanceName)
+				if err != nil {
+					slog.Error("Failed to freeze the session", logSession, instanceUUID, logInstance, instanceName, logError, err)
+				}
+			}
+		}
+	}
+}
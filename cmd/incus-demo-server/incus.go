@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"io"
+
+	"github.com/lxc/incus/v6/client"
+	"github.com/lxc/incus/v6/shared/api"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// incusServer wraps the Incus client to record and trace the API calls made by the daemon.
+type incusServer struct {
+	incus.InstanceServer
+
+	ctx context.Context
+}
+
+// incusWithContext returns a client whose API calls are traced as children of the provided context.
+func incusWithContext(d incus.InstanceServer, ctx context.Context) incus.InstanceServer {
+	wrapped, ok := d.(*incusServer)
+	if !ok {
+		return d
+	}
+
+	return &incusServer{InstanceServer: wrapped.InstanceServer, ctx: ctx}
+}
+
+// start opens the span for an Incus API call.
+func (s *incusServer) start(call string) trace.Span {
+	ctx := s.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	_, span := tracer.Start(ctx, "incus."+call, trace.WithSpanKind(trace.SpanKindClient))
+
+	return span
+}
+
+// incusRecord accounts for the result of an Incus API call.
+func incusRecord(span trace.Span, call string, err error) {
+	if err != nil {
+		metricIncusErrors.inc(call)
+	}
+
+	traceEnd(span, err)
+}
+
+// incusOperation wraps an Incus operation so failures reported while waiting on it are accounted for too.
+type incusOperation struct {
+	incus.Operation
+
+	call string
+}
+
+// incusWrapOperation returns the operation wrapped for accounting (nil if there's no operation).
+func incusWrapOperation(op incus.Operation, call string) incus.Operation {
+	if op == nil {
+		return nil
+	}
+
+	return &incusOperation{Operation: op, call: call}
+}
+
+func (op *incusOperation) Wait() error {
+	err := op.Operation.Wait()
+	if err != nil {
+		metricIncusErrors.inc(op.call)
+	}
+
+	return err
+}
+
+func (op *incusOperation) WaitContext(ctx context.Context) error {
+	err := op.Operation.WaitContext(ctx)
+	if err != nil {
+		metricIncusErrors.inc(op.call)
+	}
+
+	return err
+}
+
+// incusRemoteOperation is the incusOperation equivalent for operations spanning multiple servers.
+type incusRemoteOperation struct {
+	incus.RemoteOperation
+
+	call string
+}
+
+func (op *incusRemoteOperation) Wait() error {
+	err := op.RemoteOperation.Wait()
+	if err != nil {
+		metricIncusErrors.inc(op.call)
+	}
+
+	return err
+}
+
+func (s *incusServer) GetServer() (*api.Server, string, error) {
+	span := s.start("GetServer")
+	server, etag, err := s.InstanceServer.GetServer()
+	incusRecord(span, "GetServer", err)
+
+	return server, etag, err
+}
+
+func (s *incusServer) GetInstanceNames(instanceType api.InstanceType) ([]string, error) {
+	span := s.start("GetInstanceNames")
+	names, err := s.InstanceServer.GetInstanceNames(instanceType)
+	incusRecord(span, "GetInstanceNames", err)
+
+	return names, err
+}
+
+func (s *incusServer) GetInstance(name string) (*api.Instance, string, error) {
+	span := s.start("GetInstance")
+	instance, etag, err := s.InstanceServer.GetInstance(name)
+	incusRecord(span, "GetInstance", err)
+
+	return instance, etag, err
+}
+
+func (s *incusServer) CreateInstance(instance api.InstancesPost) (incus.Operation, error) {
+	span := s.start("CreateInstance")
+	op, err := s.InstanceServer.CreateInstance(instance)
+	incusRecord(span, "CreateInstance", err)
+
+	return incusWrapOperation(op, "CreateInstance"), err
+}
+
+func (s *incusServer) CopyInstance(source incus.InstanceServer, instance api.Instance, args *incus.InstanceCopyArgs) (incus.RemoteOperation, error) {
+	// Hand the underlying client to Incus.
+	wrapped, ok := source.(*incusServer)
+	if ok {
+		source = wrapped.InstanceServer
+	}
+
+	span := s.start("CopyInstance")
+	op, err := s.InstanceServer.CopyInstance(source, instance, args)
+	incusRecord(span, "CopyInstance", err)
+	if op == nil {
+		return nil, err
+	}
+
+	return &incusRemoteOperation{RemoteOperation: op, call: "CopyInstance"}, err
+}
+
+func (s *incusServer) UpdateInstance(name string, instance api.InstancePut, ETag string) (incus.Operation, error) {
+	span := s.start("UpdateInstance")
+	op, err := s.InstanceServer.UpdateInstance(name, instance, ETag)
+	incusRecord(span, "UpdateInstance", err)
+
+	return incusWrapOperation(op, "UpdateInstance"), err
+}
+
+func (s *incusServer) DeleteInstance(name string) (incus.Operation, error) {
+	span := s.start("DeleteInstance")
+	op, err := s.InstanceServer.DeleteInstance(name)
+	incusRecord(span, "DeleteInstance", err)
+
+	return incusWrapOperation(op, "DeleteInstance"), err
+}
+
+func (s *incusServer) ExecInstance(instanceName string, exec api.InstanceExecPost, args *incus.InstanceExecArgs) (incus.Operation, error) {
+	span := s.start("ExecInstance")
+	op, err := s.InstanceServer.ExecInstance(instanceName, exec, args)
+	incusRecord(span, "ExecInstance", err)
+
+	return incusWrapOperation(op, "ExecInstance"), err
+}
+
+func (s *incusServer) ConsoleInstance(instanceName string, console api.InstanceConsolePost, args *incus.InstanceConsoleArgs) (incus.Operation, error) {
+	span := s.start("ConsoleInstance")
+	op, err := s.InstanceServer.ConsoleInstance(instanceName, console, args)
+	incusRecord(span, "ConsoleInstance", err)
+
+	return incusWrapOperation(op, "ConsoleInstance"), err
+}
+
+func (s *incusServer) GetInstanceFile(instanceName string, path string) (io.ReadCloser, *incus.InstanceFileResponse, error) {
+	span := s.start("GetInstanceFile")
+	content, resp, err := s.InstanceServer.GetInstanceFile(instanceName, path)
+	incusRecord(span, "GetInstanceFile", err)
+
+	return content, resp, err
+}
+
+func (s *incusServer) CreateInstanceFile(instanceName string, path string, args incus.InstanceFileArgs) error {
+	span := s.start("CreateInstanceFile")
+	err := s.InstanceServer.CreateInstanceFile(instanceName, path, args)
+	incusRecord(span, "CreateInstanceFile", err)
+
+	return err
+}
+
+func (s *incusServer) DeleteInstanceFile(instanceName string, path string) error {
+	span := s.start("DeleteInstanceFile")
+	err := s.InstanceServer.DeleteInstanceFile(instanceName, path)
+	incusRecord(span, "DeleteInstanceFile", err)
+
+	return err
+}
+
+func (s *incusServer) GetInstanceSnapshots(instanceName string) ([]api.InstanceSnapshot, error) {
+	span := s.start("GetInstanceSnapshots")
+	snapshots, err := s.InstanceServer.GetInstanceSnapshots(instanceName)
+	incusRecord(span, "GetInstanceSnapshots", err)
+
+	return snapshots, err
+}
+
+func (s *incusServer) CreateInstanceSnapshot(instanceName string, snapshot api.InstanceSnapshotsPost) (incus.Operation, error) {
+	span := s.start("CreateInstanceSnapshot")
+	op, err := s.InstanceServer.CreateInstanceSnapshot(instanceName, snapshot)
+	incusRecord(span, "CreateInstanceSnapshot", err)
+
+	return incusWrapOperation(op, "CreateInstanceSnapshot"), err
+}
+
+func (s *incusServer) DeleteInstanceSnapshot(instanceName string, name string) (incus.Operation, error) {
+	span := s.start("DeleteInstanceSnapshot")
+	op, err := s.InstanceServer.DeleteInstanceSnapshot(instanceName, name)
+	incusRecord(span, "DeleteInstanceSnapshot", err)
+
+	return incusWrapOperation(op, "DeleteInstanceSnapshot"), err
+}
+
+func (s *incusServer) GetInstanceState(name string) (*api.InstanceState, string, error) {
+	span := s.start("GetInstanceState")
+	state, etag, err := s.InstanceServer.GetInstanceState(name)
+	incusRecord(span, "GetInstanceState", err)
+
+	return state, etag, err
+}
+
+func (s *incusServer) UpdateInstanceState(name string, state api.InstanceStatePut, ETag string) (incus.Operation, error) {
+	span := s.start("UpdateInstanceState")
+	op, err := s.InstanceServer.UpdateInstanceState(name, state, ETag)
+	incusRecord(span, "UpdateInstanceState", err)
+
+	return incusWrapOperation(op, "UpdateInstanceState"), err
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a simple token bucket shared by all connections of a session.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	return &rateLimiter{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// wait blocks until n bytes can be transferred.
+func (l *rateLimiter) wait(n int) {
+	l.mu.Lock()
+
+	// Refill the bucket (capped at one second worth of data).
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+
+	l.last = now
+
+	// Consume the tokens, sleeping off any debt (without holding the lock).
+	l.tokens -= float64(n)
+
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+
+	l.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// allow consumes n tokens if available, returning false (without waiting) otherwise.
+func (l *rateLimiter) allow(n int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Refill the bucket (capped at one second worth of tokens).
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+
+	l.last = now
+
+	if l.tokens < float64(n) {
+		return false
+	}
+
+	l.tokens -= float64(n)
+
+	return true
+}
+
+// rateLimitedConn applies a rate limiter to both directions of a connection.
+type rateLimitedConn struct {
+	net.Conn
+	limiter *rateLimiter
+}
+
+func (c *rateLimitedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.limiter.wait(n)
+	}
+
+	return n, err
+}
+
+func (c *rateLimitedConn) Write(p []byte) (int, error) {
+	c.limiter.wait(len(p))
+
+	return c.Conn.Write(p)
+}
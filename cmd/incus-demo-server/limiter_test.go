@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	tests := []struct {
+		name     string
+		rate     int64
+		requests []int
+		want     []bool
+	}{
+		{name: "within the burst", rate: 100, requests: []int{40, 40, 20}, want: []bool{true, true, true}},
+		{name: "past the burst", rate: 100, requests: []int{60, 60, 40}, want: []bool{true, false, true}},
+		{name: "larger than the bucket", rate: 100, requests: []int{101, 100}, want: []bool{false, true}},
+		{name: "empty bucket", rate: 100, requests: []int{100, 1}, want: []bool{true, false}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := newRateLimiter(tt.rate)
+
+			for i, n := range tt.requests {
+				got := limiter.allow(n)
+				if got != tt.want[i] {
+					t.Fatalf("request %d of %d bytes: allow() = %v, expected %v", i, n, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimiterRefill(t *testing.T) {
+	limiter := newRateLimiter(1000)
+
+	if !limiter.allow(1000) {
+		t.Fatal("A full bucket should allow its rate")
+	}
+
+	// Pretend half a second went by.
+	limiter.last = limiter.last.Add(-500 * time.Millisecond)
+
+	if limiter.allow(600) {
+		t.Fatal("Half a second shouldn't refill more than half the rate")
+	}
+
+	if !limiter.allow(400) {
+		t.Fatal("Half a second should refill half the rate")
+	}
+
+	// The bucket never holds more than one second worth of tokens.
+	limiter.last = limiter.last.Add(-time.Hour)
+
+	if limiter.allow(1001) {
+		t.Fatal("The bucket shouldn't hold more than its rate")
+	}
+}
+
+func TestRateLimiterWait(t *testing.T) {
+	limiter := newRateLimiter(10000)
+
+	start := time.Now()
+	limiter.wait(10000)
+	if time.Since(start) > 50*time.Millisecond {
+		t.Fatal("Waiting on a full bucket shouldn't block")
+	}
+
+	// Going 1000 bytes into debt at 10000 bytes per second is a 100ms wait.
+	start = time.Now()
+	limiter.wait(1000)
+	elapsed := time.Since(start)
+	if elapsed < 80*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("Expected a wait of about 100ms, got %v", elapsed)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/pborman/uuid"
+)
+
+// Fields shared by all log entries.
+const (
+	logSession  = "session"
+	logInstance = "instance"
+	logClient   = "client_ip"
+	logRequest  = "request_id"
+	logStage    = "stage"
+	logError    = "err"
+)
+
+type logContextKey struct{}
+
+// logSetup configures the default logger from the configuration.
+func logSetup() error {
+	var level slog.Level
+
+	err := level.UnmarshalText([]byte(config.Server.Log.Level))
+	if err != nil {
+		return fmt.Errorf("Invalid log level %q", config.Server.Log.Level)
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+
+	switch strings.ToLower(config.Server.Log.Format) {
+	case "text":
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, opts)))
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, opts)))
+	default:
+		return fmt.Errorf("Invalid log format %q", config.Server.Log.Format)
+	}
+
+	return nil
+}
+
+// logMiddleware tags every request with an ID, also returned to the client.
+func logMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := uuid.NewRandom().String()
+		w.Header().Set("X-Request-ID", requestID)
+
+		attrs := []any{logRequest, requestID}
+
+		clientIP, _, err := restClientIP(r)
+		if err == nil {
+			attrs = append(attrs, logClient, clientIP)
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), logContextKey{}, attrs)))
+	})
+}
+
+// logRequestLogger returns a logger carrying the request fields.
+func logRequestLogger(r *http.Request) *slog.Logger {
+	attrs, ok := r.Context().Value(logContextKey{}).([]any)
+	if !ok {
+		return slog.Default()
+	}
+
+	return slog.Default().With(attrs...)
+}
@@ -1,14 +1,22 @@
 package main
 
 import (
+	"context"
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log/slog"
 	"math/rand"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
@@ -20,15 +28,16 @@ import (
 
 // Global variables.
 var (
-	incusDaemon incus.InstanceServer
-	config      serverConfig
+	incusDaemon        incus.InstanceServer
+	config             serverConfig
+	serverShuttingDown atomic.Bool
 )
 
 func main() {
 	rand.Seed(time.Now().UTC().UnixNano())
 	err := run()
 	if err != nil {
-		fmt.Printf("error: %s\n", err)
+		slog.Error("Failed to run the daemon", logError, err)
 		os.Exit(1)
 	}
 }
@@ -54,6 +63,176 @@ func parseConfig() error {
 		config.Session.Command = []string{"bash"}
 	}
 
+	if config.Session.ExpiryWarnings == nil {
+		config.Session.ExpiryWarnings = []int{600, 300, 60}
+	}
+
+	if config.Session.Freeze.PauseExpiry && (config.Session.Freeze.Grace <= 0 || config.Session.IdleTimeout <= 0) {
+		return fmt.Errorf("Pausing the expiry of frozen sessions requires a freeze grace period and an idle timeout")
+	}
+
+	// The ready command predates probes and is handled as an exec probe.
+	config.Session.probes = slices.Clone(config.Session.Probes)
+	if len(config.Session.probes) == 0 && len(config.Session.ReadyCommand) > 0 {
+		config.Session.probes = []readinessProbe{{Type: probeExec, Command: config.Session.ReadyCommand}}
+	}
+
+	for i, probe := range config.Session.probes {
+		if !slices.Contains([]string{probeExec, probeTCP, probeHTTP, probeCloudInit}, probe.Type) {
+			return fmt.Errorf("Invalid probe type %q", probe.Type)
+		}
+
+		if probe.Type == probeExec && len(probe.Command) == 0 {
+			return fmt.Errorf("Exec probes require a command")
+		}
+
+		if slices.Contains([]string{probeTCP, probeHTTP}, probe.Type) && (probe.Port <= 0 || probe.Port > 65535) {
+			return fmt.Errorf("Invalid port for %s probe", probe.Type)
+		}
+
+		if probe.Type == probeHTTP && !strings.HasPrefix(probe.Path, "/") {
+			config.Session.probes[i].Path = "/" + probe.Path
+		}
+
+		if probe.Timeout <= 0 {
+			config.Session.probes[i].Timeout = 30
+		}
+
+		if probe.Interval <= 0 {
+			config.Session.probes[i].Interval = 1
+		}
+	}
+
+	if config.Session.NetworkTimeout <= 0 {
+		config.Session.NetworkTimeout = 30
+	}
+
+	if config.Session.Exec.Rate <= 0 {
+		config.Session.Exec.Rate = 1
+	}
+
+	if config.Session.Exec.Concurrency <= 0 {
+		config.Session.Exec.Concurrency = 1
+	}
+
+	if config.Session.Exec.Timeout <= 0 {
+		config.Session.Exec.Timeout = 30
+	}
+
+	if config.Session.Exec.MaxInput <= 0 {
+		config.Session.Exec.MaxInput = 65536
+	}
+
+	if config.Session.Exec.MaxOutput <= 0 {
+		config.Session.Exec.MaxOutput = 1048576
+	}
+
+	if len(config.Session.Export.Paths) > 0 && config.Session.Export.Path == "" {
+		return fmt.Errorf("Session exports require a path to store the archives in")
+	}
+
+	for _, exportPath := range config.Session.Export.Paths {
+		if !filepath.IsAbs(exportPath) {
+			return fmt.Errorf("Invalid export path %q, must be absolute", exportPath)
+		}
+	}
+
+	if config.Session.Export.Expiry <= 0 {
+		config.Session.Export.Expiry = 86400
+	}
+
+	if config.Session.Export.Timeout <= 0 {
+		config.Session.Export.Timeout = 300
+	}
+
+	if config.Session.ConsoleMode == "" {
+		config.Session.ConsoleMode = consoleModeExec
+	}
+
+	if !slices.Contains([]string{consoleModeExec, consoleModeConsole}, config.Session.ConsoleMode) {
+		return fmt.Errorf("Invalid console mode %q", config.Session.ConsoleMode)
+	}
+
+	err = flavorValidate()
+	if err != nil {
+		return err
+	}
+
+	for i, mapping := range config.Server.Proxy.Mappings {
+		if !strings.HasPrefix(mapping.Name, "{uuid}.") {
+			return fmt.Errorf("Proxy mapping %q must start with \"{uuid}.\"", mapping.Name)
+		}
+
+		if mapping.Port <= 0 || mapping.Port > 65535 {
+			return fmt.Errorf("Invalid port for proxy mapping %q", mapping.Name)
+		}
+
+		if mapping.TLS == "" {
+			config.Server.Proxy.Mappings[i].TLS = proxyTLSTerminate
+		} else if !slices.Contains([]string{proxyTLSTerminate, proxyTLSPassthrough}, mapping.TLS) {
+			return fmt.Errorf("Invalid TLS mode for proxy mapping %q", mapping.Name)
+		}
+	}
+
+	if config.Server.Log.Level == "" {
+		config.Server.Log.Level = "info"
+	}
+
+	if config.Server.Log.Format == "" {
+		config.Server.Log.Format = "text"
+	}
+
+	err = logSetup()
+	if err != nil {
+		return err
+	}
+
+	if config.Server.Maintenance.Notice == 0 {
+		config.Server.Maintenance.Notice = 86400
+	}
+
+	if config.Server.Maintenance.MinimumSession == 0 {
+		config.Server.Maintenance.MinimumSession = 600
+	}
+
+	for _, window := range config.Server.Maintenance.Windows {
+		if window.Start.IsZero() || !window.End.After(window.Start) {
+			return fmt.Errorf("Invalid maintenance window starting at %s", window.Start)
+		}
+	}
+
+	for i, entry := range config.Server.Announcements {
+		if entry.Severity == "" {
+			config.Server.Announcements[i].Severity = announcementInfo
+		} else if !slices.Contains([]string{announcementInfo, announcementWarning, announcementCritical}, entry.Severity) {
+			return fmt.Errorf("Invalid severity for announcement %q", entry.Message)
+		}
+	}
+
+	if config.Server.Playground.Timeout <= 0 {
+		config.Server.Playground.Timeout = 10
+	}
+
+	if config.Server.Playground.MaxScript <= 0 {
+		config.Server.Playground.MaxScript = 65536
+	}
+
+	if config.Server.Playground.MaxOutput <= 0 {
+		config.Server.Playground.MaxOutput = 65536
+	}
+
+	if config.Server.Playground.CacheExpiry <= 0 {
+		config.Server.Playground.CacheExpiry = 3600
+	}
+
+	if config.Server.Playground.Limits.Total <= 0 {
+		config.Server.Playground.Limits.Total = 2
+	}
+
+	if config.Server.Scenarios.CheckTimeout <= 0 {
+		config.Server.Scenarios.CheckTimeout = 10
+	}
+
 	if config.Instance.Source.InstanceType == "" {
 		config.Instance.Source.InstanceType = "container"
 	}
@@ -63,6 +242,27 @@ func parseConfig() error {
 	io.WriteString(hash, config.Server.Terms)
 	config.Server.termsHash = fmt.Sprintf("%x", hash.Sum(nil))
 
+	err = cloudInitLoad(&config.Instance.CloudInit.UserData, "user-data")
+	if err != nil {
+		return err
+	}
+
+	err = cloudInitLoad(&config.Instance.CloudInit.VendorData, "vendor-data")
+	if err != nil {
+		return err
+	}
+
+	err = cloudInitLoad(&config.Instance.CloudInit.NetworkConfig, "network-config")
+	if err != nil {
+		return err
+	}
+
+	// Pre-allocated instances are created before the session data the templates need is known.
+	if config.Instance.Allocate.Count > 0 && cloudInitEnabled() {
+		slog.Warn("Pre-allocated instances are disabled when cloud-init templates are set")
+		config.Instance.Allocate.Count = 0
+	}
+
 	if config.Instance.Source.Instance == "" && config.Instance.Source.Image == "" {
 		return fmt.Errorf("No instance or image specified in configuration")
 	}
@@ -71,6 +271,11 @@ func parseConfig() error {
 		return fmt.Errorf("Only one of instance or image can be specified as the source")
 	}
 
+	err = scenarioLoadAll()
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -81,6 +286,12 @@ func run() error {
 		return err
 	}
 
+	// Setup tracing (changes require a restart).
+	err = traceSetup()
+	if err != nil {
+		return err
+	}
+
 	// Watch for configuration changes.
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
@@ -92,10 +303,23 @@ func run() error {
 		return fmt.Errorf("Unable to setup fsnotify watch: %s", err)
 	}
 
+	scenarioWatch(watcher)
+
 	go func() {
 		for {
 			select {
 			case ev := <-watcher.Events:
+				if scenarioIsWatched(ev.Name) {
+					slog.Info("Reloading scenarios")
+					err := scenarioLoadAll()
+					if err != nil {
+						slog.Error("Failed to load scenarios", logError, err)
+					}
+
+					scenarioWatch(watcher)
+					continue
+				}
+
 				if ev.Name != "./config.yaml" {
 					continue
 				}
@@ -104,13 +328,15 @@ func run() error {
 					continue
 				}
 
-				fmt.Printf("Reloading configuration\n")
+				slog.Info("Reloading configuration")
 				err := parseConfig()
 				if err != nil {
-					fmt.Printf("Failed to parse configuration: %s\n", err)
+					slog.Error("Failed to parse configuration", logError, err)
 				}
+
+				scenarioWatch(watcher)
 			case err := <-watcher.Errors:
-				fmt.Printf("Inotify error: %s\n", err)
+				slog.Error("Inotify error", logError, err)
 			}
 		}
 	}()
@@ -146,7 +372,7 @@ func run() error {
 			}
 
 			if !warning {
-				fmt.Printf("Waiting for the Incus server to come online.\n")
+				slog.Warn("Waiting for the Incus server to come online")
 				warning = true
 			}
 
@@ -161,14 +387,16 @@ func run() error {
 			incusDaemon = incusDaemon.UseTarget(config.Incus.Target)
 		}
 
+		incusDaemon = &incusServer{InstanceServer: incusDaemon}
+
 		if warning {
-			fmt.Printf("Incus is now available.\n")
+			slog.Info("Incus is now available")
 		}
 
 		// Restore cleanup handler for existing instances.
 		instances, err := dbActive()
 		if err != nil {
-			fmt.Printf("Unable to read current instances: %s", err)
+			slog.Error("Unable to read current instances", logError, err)
 			return
 		}
 
@@ -176,25 +404,15 @@ func run() error {
 			instanceID := int64(entry[0].(int))
 			instanceName := entry[1].(string)
 			instanceExpiry := int64(entry[2].(int))
+			instanceUUID := entry[3].(string)
 
-			duration := instanceExpiry - time.Now().Unix()
-			timeDuration, err := time.ParseDuration(fmt.Sprintf("%ds", duration))
-			if err != nil || duration <= 0 {
-				incusForceDelete(incusDaemon, instanceName)
-				dbExpire(instanceID)
-				continue
-			}
-
-			time.AfterFunc(timeDuration, func() {
-				incusForceDelete(incusDaemon, instanceName)
-				dbExpire(instanceID)
-			})
+			sessionSchedule(instanceID, instanceUUID, instanceName, instanceExpiry)
 		}
 
 		// Delete former pre-allocated instances.
 		instances, err = dbAllocated()
 		if err != nil {
-			fmt.Printf("Unable to read pre-allocated instances: %s", err)
+			slog.Error("Unable to read pre-allocated instances", logError, err)
 			return
 		}
 
@@ -203,13 +421,17 @@ func run() error {
 			instanceName := entry[1].(string)
 
 			incusForceDelete(incusDaemon, instanceName)
-			dbDelete(instanceID)
+
+			err = dbDelete(instanceID)
+			if err != nil {
+				slog.Error("Failed to delete the session record", logInstance, instanceName, logError, err)
+			}
 		}
 
 		// Cleanup instance list.
 		err = instanceResync()
 		if err != nil {
-			fmt.Printf("Unable to perform instance cleanup: %s", err)
+			slog.Error("Unable to perform instance cleanup", logError, err)
 			return
 		}
 
@@ -218,7 +440,10 @@ func run() error {
 			for {
 				time.Sleep(time.Hour)
 
-				_ = instanceResync()
+				err := instanceResync()
+				if err != nil {
+					slog.Error("Unable to perform instance cleanup", logError, err)
+				}
 			}
 		}()
 
@@ -226,12 +451,19 @@ func run() error {
 		for i := 0; i < config.Instance.Allocate.Count; i++ {
 			err := instancePreAllocate()
 			if err != nil {
-				fmt.Printf("Failed to pre-allocate instance: %s", err)
+				slog.Error("Failed to pre-allocate instance", logError, err)
 				return
 			}
 		}
 	}()
 
+	// Warn users about upcoming maintenance.
+	go maintenanceMonitor()
+
+	// Reclaim idle sessions.
+	go idleMonitor()
+	go exportMonitor()
+
 	// Spawn the proxy.
 	if config.Server.Proxy.Address != "" {
 		if config.Server.Proxy.Certificate == "" && config.Server.Proxy.Key == "" {
@@ -247,22 +479,114 @@ func run() error {
 		go proxyListener()
 	}
 
+	// Spawn the metrics listener.
+	if config.Server.Metrics.Address != "" {
+		go metricsListener()
+	}
+
+	// Spawn the web proxy.
+	if config.Server.Web.Address != "" {
+		go webListener()
+	}
+
+	// Spawn the SSH gateway.
+	if config.Server.SSH.Address != "" {
+		go sshListener()
+	}
+
 	// Setup the HTTP server.
 	r := mux.NewRouter()
+	r.Use(logMiddleware)
 	r.Handle("/", http.RedirectHandler("/static", http.StatusMovedPermanently))
 	r.PathPrefix("/static").Handler(http.StripPrefix("/static", http.FileServer(http.Dir("static/"))))
+	r.HandleFunc("/healthz", restHealthzHandler)
+	r.HandleFunc("/readyz", restReadyzHandler)
 	r.HandleFunc("/1.0", restStatusHandler)
+	r.HandleFunc("/1.0/admin/drain", restAdminDrainHandler)
 	r.HandleFunc("/1.0/console", restConsoleHandler)
+	r.HandleFunc("/1.0/console/resize", restConsoleResizeHandler)
+	r.HandleFunc("/1.0/events", restEventsHandler)
+	r.HandleFunc("/1.0/exec", restExecHandler)
+	r.HandleFunc("/1.0/export", restExportHandler)
 	r.HandleFunc("/1.0/feedback", restFeedbackHandler)
+	r.HandleFunc("/1.0/files", restFilesHandler)
 	r.HandleFunc("/1.0/info", restInfoHandler)
+	r.HandleFunc("/1.0/invite", restInviteHandler)
+	r.HandleFunc("/1.0/remote", restRemoteHandler)
+	r.HandleFunc("/1.0/run", restRunHandler)
+	r.HandleFunc("/1.0/scenario", restScenarioHandler)
+	r.HandleFunc("/1.0/scenario/check", restScenarioCheckHandler)
+	r.HandleFunc("/1.0/scenarios", restScenariosHandler)
+	r.HandleFunc("/1.0/reset", restResetHandler)
+	r.HandleFunc("/1.0/snapshots", restSnapshotsHandler)
+	r.HandleFunc("/1.0/ssh", restSSHHandler)
 	r.HandleFunc("/1.0/start", restStartHandler)
 	r.HandleFunc("/1.0/statistics", restStatisticsHandler)
+	r.HandleFunc("/1.0/statistics/scenarios", restStatisticsScenariosHandler)
 	r.HandleFunc("/1.0/terms", restTermsHandler)
 
-	err = http.ListenAndServe(config.Server.API.Address, r)
-	if err != nil {
+	if config.Server.Metrics.Address == "" && len(config.Server.Metrics.Keys) > 0 {
+		r.HandleFunc("/metrics", restMetricsHandler)
+	}
+
+	srv := &http.Server{Addr: config.Server.API.Address, Handler: r}
+
+	// Shutdown cleanly on SIGTERM and SIGINT.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	done := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		serverShutdown(srv)
+		close(done)
+	}()
+
+	err = srv.ListenAndServe()
+	if !errors.Is(err, http.ErrServerClosed) {
 		return err
 	}
 
+	<-done
+
 	return nil
 }
+
+// serverShutdown stops accepting new sessions, waits for in-flight ones to be created and disconnects all consoles.
+func serverShutdown(srv *http.Server) {
+	slog.Info("Shutting down")
+	serverShuttingDown.Store(true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// Stop accepting requests and wait for the running ones (including session starts) to complete.
+	err := srv.Shutdown(ctx)
+	if err != nil {
+		slog.Warn("Timed out waiting for requests to complete", logError, err)
+	}
+
+	// Wait for instance creations to complete (or roll back on failure) and prevent new ones.
+	locked := make(chan struct{})
+	go func() {
+		muCreate.Lock()
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+	case <-ctx.Done():
+		slog.Warn("Timed out waiting for instance creation, leftovers will be cleaned up on next start")
+	}
+
+	// Disconnect all consoles.
+	consoleCloseAll("The server is shutting down")
+
+	// Flush the traces.
+	if tracerProvider != nil {
+		err = tracerProvider.Shutdown(ctx)
+		if err != nil {
+			slog.Warn("Failed to flush traces", logError, err)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"time"
+)
+
+const (
+	announcementInfo     = "info"
+	announcementWarning  = "warning"
+	announcementCritical = "critical"
+)
+
+// maintenanceWarnings are the delays before a window at which active users are warned.
+var maintenanceWarnings = []time.Duration{time.Minute, 5 * time.Minute, 15 * time.Minute}
+
+// maintenanceCurrent returns the maintenance window in effect (if any).
+func maintenanceCurrent() *maintenanceWindow {
+	now := time.Now()
+
+	for i, window := range config.Server.Maintenance.Windows {
+		if !now.Before(window.Start) && now.Before(window.End) {
+			return &config.Server.Maintenance.Windows[i]
+		}
+	}
+
+	return nil
+}
+
+// maintenanceNext returns the next upcoming maintenance window (if any).
+func maintenanceNext() *maintenanceWindow {
+	now := time.Now()
+
+	var next *maintenanceWindow
+	for i, window := range config.Server.Maintenance.Windows {
+		if !window.Start.After(now) {
+			continue
+		}
+
+		if next == nil || window.Start.Before(next.Start) {
+			next = &config.Server.Maintenance.Windows[i]
+		}
+	}
+
+	return next
+}
+
+// maintenanceEnabled returns whether the server is in maintenance, either manually or through a window.
+func maintenanceEnabled() bool {
+	return config.Server.Maintenance.Enabled || maintenanceCurrent() != nil
+}
+
+// maintenanceMessage returns the message to show while in maintenance.
+func maintenanceMessage() string {
+	window := maintenanceCurrent()
+	if window != nil && window.Message != "" {
+		return window.Message
+	}
+
+	return config.Server.Maintenance.Message
+}
+
+// maintenanceSessionExpiry shortens the session expiry so it ends before the next maintenance window.
+func maintenanceSessionExpiry(expiry int) (int, error) {
+	window := maintenanceNext()
+	if window == nil {
+		return expiry, nil
+	}
+
+	remaining := int(time.Until(window.Start).Seconds())
+	if remaining >= expiry {
+		return expiry, nil
+	}
+
+	if remaining < config.Server.Maintenance.MinimumSession {
+		return 0, fmt.Errorf("Maintenance window starting in %ds", remaining)
+	}
+
+	return remaining, nil
+}
+
+// maintenanceMonitor warns active users of upcoming maintenance windows and ends their sessions once one starts.
+func maintenanceMonitor() {
+	warned := map[time.Time]time.Duration{}
+	ended := map[time.Time]bool{}
+
+	for {
+		time.Sleep(10 * time.Second)
+
+		current := maintenanceCurrent()
+		if current != nil && !ended[current.Start] && incusDaemon != nil {
+			instances, err := dbActive()
+			if err != nil {
+				slog.Error("Unable to read current instances", logError, err)
+			} else {
+				ended[current.Start] = true
+
+				for _, entry := range instances {
+					sessionEnd(int64(entry[0].(int)), entry[3].(string), entry[1].(string), sessionEndMaintenance)
+				}
+			}
+		}
+
+		window := maintenanceNext()
+		if window == nil {
+			continue
+		}
+
+		remaining := time.Until(window.Start)
+		for _, delay := range maintenanceWarnings {
+			if remaining > delay {
+				continue
+			}
+
+			// Only warn once for each threshold.
+			last, ok := warned[window.Start]
+			if ok && last <= delay {
+				break
+			}
+
+			warned[window.Start] = delay
+
+			message := fmt.Sprintf("Scheduled maintenance starts in %d minute(s), this session will be terminated.", int(math.Ceil(remaining.Minutes())))
+			if window.Message != "" {
+				message = fmt.Sprintf("%s %s", message, window.Message)
+			}
+
+			consoleBroadcast(message)
+			break
+		}
+	}
+}
+
+// announcementsActive returns the announcements to display right now.
+func announcementsActive() []map[string]any {
+	now := time.Now()
+	announcements := []map[string]any{}
+
+	for _, entry := range config.Server.Announcements {
+		if !entry.Start.IsZero() && now.Before(entry.Start) {
+			continue
+		}
+
+		if !entry.End.IsZero() && !now.Before(entry.End) {
+			continue
+		}
+
+		announcement := map[string]any{
+			"message":  entry.Message,
+			"severity": entry.Severity,
+		}
+
+		if !entry.Start.IsZero() {
+			announcement["start"] = entry.Start.Unix()
+		}
+
+		if !entry.End.IsZero() {
+			announcement["end"] = entry.End.Unix()
+		}
+
+		announcements = append(announcements, announcement)
+	}
+
+	return announcements
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMaintenanceSessionExpiry(t *testing.T) {
+	previous := config
+	t.Cleanup(func() { config = previous })
+
+	// Windows are relative to now, half a second past the mark to absorb the time the test takes.
+	window := func(start time.Duration) maintenanceWindow {
+		begin := time.Now().Add(start + 500*time.Millisecond)
+		return maintenanceWindow{Start: begin, End: begin.Add(time.Hour)}
+	}
+
+	tests := []struct {
+		name    string
+		windows []maintenanceWindow
+		minimum int
+		expiry  int
+		want    int
+		wantErr bool
+	}{
+		{name: "no window", expiry: 3600, want: 3600},
+		{name: "past window", windows: []maintenanceWindow{window(-2 * time.Hour)}, expiry: 3600, want: 3600},
+		{name: "window after expiry", windows: []maintenanceWindow{window(2 * time.Hour)}, expiry: 3600, want: 3600},
+		{name: "window at expiry", windows: []maintenanceWindow{window(time.Hour)}, expiry: 3600, want: 3600},
+		{name: "window before expiry", windows: []maintenanceWindow{window(30 * time.Minute)}, expiry: 3600, want: 1800},
+		{name: "nearest window", windows: []maintenanceWindow{window(50 * time.Minute), window(20 * time.Minute)}, expiry: 3600, want: 1200},
+		{name: "above minimum", windows: []maintenanceWindow{window(10 * time.Minute)}, minimum: 300, expiry: 3600, want: 600},
+		{name: "below minimum", windows: []maintenanceWindow{window(2 * time.Minute)}, minimum: 300, expiry: 3600, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Server.Maintenance.Windows = tt.windows
+			config.Server.Maintenance.MinimumSession = tt.minimum
+
+			got, err := maintenanceSessionExpiry(tt.expiry)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("maintenanceSessionExpiry(%d) = %d, expected an error", tt.expiry, got)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("maintenanceSessionExpiry(%d) failed: %v", tt.expiry, err)
+			}
+
+			if got != tt.want {
+				t.Fatalf("maintenanceSessionExpiry(%d) = %d, expected %d", tt.expiry, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metric is a counter or histogram with an optional single label.
+type metric struct {
+	name    string
+	help    string
+	kind    string
+	label   string
+	buckets []float64
+
+	mu     sync.Mutex
+	values map[string]float64
+	counts map[string][]uint64
+	totals map[string]uint64
+}
+
+func newCounter(name string, help string, label string) *metric {
+	return &metric{name: name, help: help, kind: "counter", label: label, values: map[string]float64{}}
+}
+
+func newHistogram(name string, help string, label string, buckets []float64) *metric {
+	return &metric{name: name, help: help, kind: "histogram", label: label, buckets: buckets, values: map[string]float64{}, counts: map[string][]uint64{}, totals: map[string]uint64{}}
+}
+
+// Global variables.
+var (
+	metricStageDuration  = newHistogram("incus_demo_instance_stage_duration_seconds", "Time spent in each stage of instance creation and startup.", "stage", []float64{0.5, 1, 2, 5, 10, 20, 30, 60, 120})
+	metricCreateFailures = newCounter("incus_demo_instance_create_failures_total", "Number of instances that failed to be created or started.", "")
+	metricStartRejected  = newCounter("incus_demo_session_start_rejections_total", "Number of session requests that were rejected.", "status")
+	metricProxyBytes     = newCounter("incus_demo_proxy_bytes_total", "Number of bytes forwarded by the Incus proxy.", "direction")
+	metricDBDuration     = newHistogram("incus_demo_db_query_duration_seconds", "Time spent running database queries.", "", []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5})
+	metricIncusErrors    = newCounter("incus_demo_incus_errors_total", "Number of failed Incus API calls and operations.", "call")
+	metricSessionEnds    = newCounter("incus_demo_session_ends_total", "Number of sessions that ended.", "reason")
+
+	metrics = []*metric{metricStageDuration, metricCreateFailures, metricStartRejected, metricProxyBytes, metricDBDuration, metricIncusErrors, metricSessionEnds}
+)
+
+// statusNames is used to label the session start rejections.
+var statusNames = map[statusCode]string{
+	instanceStarted:      "started",
+	instanceInvalidTerms: "invalid_terms",
+	instanceServerFull:   "server_full",
+	instanceQuotaReached: "quota_reached",
+	instanceUserBanned:   "user_banned",
+	instanceUnknownError: "unknown_error",
+	instanceDraining:     "draining",
+	instanceMaintenance:  "maintenance",
+}
+
+func (m *metric) inc(label string) {
+	m.add(label, 1)
+}
+
+func (m *metric) add(label string, value float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.values[label] += value
+}
+
+func (m *metric) observe(label string, value float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.counts[label] == nil {
+		m.counts[label] = make([]uint64, len(m.buckets))
+	}
+
+	for i, bucket := range m.buckets {
+		if value <= bucket {
+			m.counts[label][i]++
+		}
+	}
+
+	m.values[label] += value
+	m.totals[label]++
+}
+
+// observeSince records the time elapsed since the provided start time.
+func (m *metric) observeSince(label string, start time.Time) {
+	m.observe(label, time.Since(start).Seconds())
+}
+
+func (m *metric) labels(label string, extra string) string {
+	pairs := []string{}
+	if m.label != "" {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", m.label, label))
+	}
+
+	if extra != "" {
+		pairs = append(pairs, extra)
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (m *metric) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+
+	labels := make([]string, 0, len(m.values))
+	for label := range m.values {
+		labels = append(labels, label)
+	}
+
+	sort.Strings(labels)
+
+	if m.kind == "counter" {
+		if len(labels) == 0 && m.label == "" {
+			fmt.Fprintf(w, "%s 0\n", m.name)
+		}
+
+		for _, label := range labels {
+			fmt.Fprintf(w, "%s%s %v\n", m.name, m.labels(label, ""), m.values[label])
+		}
+
+		return
+	}
+
+	for _, label := range labels {
+		for i, bucket := range m.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, m.labels(label, fmt.Sprintf("le=\"%v\"", bucket)), m.counts[label][i])
+		}
+
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, m.labels(label, "le=\"+Inf\""), m.totals[label])
+		fmt.Fprintf(w, "%s_sum%s %v\n", m.name, m.labels(label, ""), m.values[label])
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, m.labels(label, ""), m.totals[label])
+	}
+}
+
+func metricsWriteGauge(w io.Writer, name string, help string, value int) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+	fmt.Fprintf(w, "%s %d\n", name, value)
+}
+
+func restMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Not implemented", 501)
+		return
+	}
+
+	// Validate API key.
+	if len(config.Server.Metrics.Keys) > 0 {
+		requestKey := r.FormValue("key")
+		bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if ok {
+			requestKey = bearer
+		}
+
+		if !slices.Contains(config.Server.Metrics.Keys, requestKey) {
+			http.Error(w, "Invalid authentication key", 401)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	// Current state.
+	activeCount, err := dbActiveCount()
+	if err != nil {
+		activeCount = -1
+	}
+
+	allocated, err := dbAllocated()
+	allocatedCount := len(allocated)
+	if err != nil {
+		allocatedCount = -1
+	}
+
+	frozenCount, err := dbGetStats("total", "frozen", false, nil)
+	if err != nil {
+		frozenCount = -1
+	}
+
+	proxyConnsLock.Lock()
+	proxyCount := proxyConnCount
+	proxyConnsLock.Unlock()
+
+	metricsWriteGauge(w, "incus_demo_sessions_active", "Number of active sessions.", activeCount)
+	metricsWriteGauge(w, "incus_demo_sessions_frozen", "Number of active sessions with a frozen instance.", int(frozenCount))
+	metricsWriteGauge(w, "incus_demo_pool_instances", "Number of pre-allocated instances.", allocatedCount)
+	metricsWriteGauge(w, "incus_demo_pool_target", "Target number of pre-allocated instances.", config.Instance.Allocate.Count)
+	metricsWriteGauge(w, "incus_demo_console_connections", "Number of open console connections.", consoleCount())
+	metricsWriteGauge(w, "incus_demo_proxy_connections", "Number of open Incus proxy connections.", proxyCount)
+
+	// Accumulated metrics.
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+func metricsListener() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", restMetricsHandler)
+
+	err := http.ListenAndServe(config.Server.Metrics.Address, mux)
+	if err != nil {
+		slog.Error("Failed to start listener", "listener", "metrics", logError, err)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lxc/incus/v6/client"
+	"github.com/lxc/incus/v6/shared/api"
+)
+
+const (
+	probeExec      = "exec"
+	probeTCP       = "tcp"
+	probeHTTP      = "http"
+	probeCloudInit = "cloud-init"
+)
+
+// errProbeFatal is returned by probe checks which can't succeed by retrying.
+var errProbeFatal = errors.New("Probe failed permanently")
+
+// probeDescription returns the progress message shown while waiting for the probe.
+func probeDescription(probe readinessProbe) string {
+	switch probe.Type {
+	case probeTCP:
+		return fmt.Sprintf("Waiting for port %d", probe.Port)
+	case probeHTTP:
+		return fmt.Sprintf("Waiting for the web service on port %d", probe.Port)
+	case probeCloudInit:
+		return "Waiting for cloud-init"
+	}
+
+	return "Waiting for the instance to be ready"
+}
+
+// probeRun retries the probe at its interval until it passes or its timeout is reached.
+func probeRun(ctx context.Context, d incus.InstanceServer, instanceName string, instanceIP string, probe readinessProbe) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(probe.Timeout)*time.Second)
+	defer cancel()
+
+	interval := time.Duration(probe.Interval) * time.Second
+
+	for {
+		err := probeCheck(ctx, d, instanceName, instanceIP, probe)
+		if err == nil {
+			return nil
+		}
+
+		if errors.Is(err, errProbeFatal) {
+			return fmt.Errorf("The %s probe failed: %w", probe.Type, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("The %s probe didn't pass within %ds: %w", probe.Type, probe.Timeout, err)
+		case <-time.After(interval):
+		}
+	}
+}
+
+// probeCheck runs a single attempt of the probe.
+func probeCheck(ctx context.Context, d incus.InstanceServer, instanceName string, instanceIP string, probe readinessProbe) error {
+	switch probe.Type {
+	case probeExec:
+		req := api.InstanceExecPost{
+			Command: probe.Command,
+		}
+
+		exitCode, err := incusExecContext(ctx, d, instanceName, req, nil, nil, nil)
+		if err != nil {
+			return err
+		}
+
+		if exitCode != 0 {
+			return fmt.Errorf("Command exited with status %d", exitCode)
+		}
+
+		return nil
+	case probeTCP, probeHTTP:
+		if instanceIP == "" {
+			return fmt.Errorf("Instance has no IP address")
+		}
+
+		addr := net.JoinHostPort(instanceIP, strconv.Itoa(probe.Port))
+
+		if probe.Type == probeTCP {
+			conn, err := (&net.Dialer{Timeout: 5 * time.Second}).DialContext(ctx, "tcp", addr)
+			if err != nil {
+				return err
+			}
+
+			_ = conn.Close()
+			return nil
+		}
+
+		req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("http://%s%s", addr, probe.Path), nil)
+		if err != nil {
+			return err
+		}
+
+		client := &http.Client{Timeout: 5 * time.Second}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+
+		_ = resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("Unexpected HTTP status %d", resp.StatusCode)
+		}
+
+		return nil
+	case probeCloudInit:
+		req := api.InstanceExecPost{
+			Command: []string{"cloud-init", "status"},
+		}
+
+		var stdout bytes.Buffer
+		_, err := incusExecContext(ctx, d, instanceName, req, nil, &stdout, nil)
+		if err != nil {
+			return err
+		}
+
+		return probeCloudInitStatus(stdout.String())
+	}
+
+	return fmt.Errorf("%w: unknown probe type %q", errProbeFatal, probe.Type)
+}
+
+// probeCloudInitStatus interprets the output of "cloud-init status", returning nil once it's done.
+func probeCloudInitStatus(output string) error {
+	if strings.Contains(output, "status: done") {
+		return nil
+	}
+
+	if strings.Contains(output, "status: error") {
+		return fmt.Errorf("%w: cloud-init reported an error", errProbeFatal)
+	}
+
+	// Nothing to wait for when cloud-init isn't in use.
+	if strings.Contains(output, "status: disabled") {
+		return nil
+	}
+
+	// Once the instance is up, cloud-init not having run means it never will.
+	if strings.Contains(output, "status: not run") || strings.Contains(output, "status: not started") {
+		return fmt.Errorf("%w: cloud-init didn't run", errProbeFatal)
+	}
+
+	return fmt.Errorf("cloud-init is still running")
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestProbeCloudInitStatus(t *testing.T) {
+	tests := []struct {
+		name      string
+		output    string
+		wantErr   bool
+		wantFatal bool
+	}{
+		{name: "done", output: "status: done\n"},
+		{name: "done with details", output: "\nstatus: done\ndetail:\nDONE\n"},
+		{name: "disabled", output: "status: disabled\n"},
+		{name: "running", output: "status: running\n", wantErr: true},
+		{name: "no output yet", output: "", wantErr: true},
+		{name: "error", output: "status: error\n", wantErr: true, wantFatal: true},
+		{name: "not run", output: "status: not run\n", wantErr: true, wantFatal: true},
+		{name: "not started", output: "status: not started\n", wantErr: true, wantFatal: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := probeCloudInitStatus(tt.output)
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("probeCloudInitStatus(%q) failed: %v", tt.output, err)
+				}
+
+				return
+			}
+
+			if err == nil {
+				t.Fatalf("probeCloudInitStatus(%q) succeeded, expected an error", tt.output)
+			}
+
+			if errors.Is(err, errProbeFatal) != tt.wantFatal {
+				t.Fatalf("probeCloudInitStatus(%q) = %v, expected fatal to be %v", tt.output, err, tt.wantFatal)
+			}
+		})
+	}
+}
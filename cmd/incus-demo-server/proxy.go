@@ -1,22 +1,52 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
-	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	incusTls "github.com/lxc/incus/v6/shared/tls"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	proxyTLSTerminate   = "terminate"
+	proxyTLSPassthrough = "passthrough"
 )
 
+// proxyDefaultMapping is used when no mappings are configured, it exposes the nested Incus API.
+var proxyDefaultMapping = proxyMapping{
+	Name:       "{uuid}",
+	Port:       8443,
+	TLS:        proxyTLSTerminate,
+	BackendTLS: true,
+}
+
+var errProxyPeeked = errors.New("ClientHello peeked")
+
+// proxyListening is set once the proxy is accepting connections.
+var proxyListening atomic.Bool
+
 func proxyListener() {
 	l, err := net.Listen("tcp", config.Server.Proxy.Address)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "proxy: Failed to start listener: %v\n", err)
+		slog.Error("Failed to start listener", "listener", "proxy", logError, err)
 		return
 	}
 
+	proxyListening.Store(true)
+
 	for {
 		conn, err := l.Accept()
 		if err != nil {
@@ -30,13 +60,47 @@ func proxyListener() {
 func proxyHandle(conn net.Conn) {
 	defer conn.Close()
 
-	// Establish TLS.
-	var target string
+	// Read the target name from the TLS ClientHello.
+	target, conn, err := proxyPeekServerName(conn)
+	if err != nil {
+		return
+	}
+
+	id := strings.Split(target, ".")[0]
+
+	// Find the mapping.
+	mapping := proxyGetMapping(target)
+	if mapping == nil {
+		return
+	}
+
+	_, span := tracer.Start(context.Background(), "proxy", trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(traceSession.String(id), attribute.String("proxy.name", target), attribute.String("proxy.tls", mapping.TLS)))
 
+	// Get the instance.
+	sessionId, instanceIP, err := proxyGetInstanceIP(id)
+	if err != nil {
+		traceEnd(span, err)
+		return
+	}
+
+	backendAddr := net.JoinHostPort(instanceIP, strconv.Itoa(mapping.Port))
+
+	// Pass the TLS session through as-is.
+	if mapping.TLS == proxyTLSPassthrough {
+		backendConn, err := net.DialTimeout("tcp", backendAddr, 10*time.Second)
+		if err != nil {
+			traceEnd(span, err)
+			return
+		}
+		defer backendConn.Close()
+
+		proxyForward(span, sessionId, id, conn, backendConn)
+		return
+	}
+
+	// Establish TLS.
 	tlsConfig := &tls.Config{
 		GetCertificate: func(info *tls.ClientHelloInfo) (*tls.Certificate, error) {
-			target = info.ServerName
-
 			cert, err := tls.X509KeyPair([]byte(config.Server.Proxy.Certificate), []byte(config.Server.Proxy.Key))
 			if err != nil {
 				return nil, err
@@ -45,8 +109,32 @@ func proxyHandle(conn net.Conn) {
 			return &cert, nil
 		},
 
+		ClientAuth: tls.RequestClientCert,
+	}
+
+	tlsConn := tls.Server(conn, tlsConfig)
+	err = tlsConn.Handshake()
+	if err != nil {
+		traceEnd(span, err)
+		return
+	}
+
+	// Pass the client identity through if it's one generated for the session.
+	clientCert := config.Incus.Client.Certificate
+	clientKey := config.Incus.Client.Key
+
+	peerCerts := tlsConn.ConnectionState().PeerCertificates
+	if len(peerCerts) > 0 {
+		cert, key, err := dbGetRemote(sessionId, incusTls.CertFingerprint(peerCerts[0]))
+		if err == nil {
+			clientCert = cert
+			clientKey = key
+		}
+	}
+
+	backendConfig := &tls.Config{
 		GetClientCertificate: func(info *tls.CertificateRequestInfo) (*tls.Certificate, error) {
-			cert, err := tls.X509KeyPair([]byte(config.Incus.Client.Certificate), []byte(config.Incus.Client.Key))
+			cert, err := tls.X509KeyPair([]byte(clientCert), []byte(clientKey))
 			if err != nil {
 				return nil, err
 			}
@@ -57,41 +145,279 @@ func proxyHandle(conn net.Conn) {
 		InsecureSkipVerify: true,
 	}
 
-	tlsConn := tls.Server(conn, tlsConfig)
-	err := tlsConn.Handshake()
+	// Connect to the instance.
+	var backendConn net.Conn
+	if mapping.BackendTLS {
+		backendConn, err = tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", backendAddr, backendConfig)
+	} else {
+		backendConn, err = net.DialTimeout("tcp", backendAddr, 10*time.Second)
+	}
+
 	if err != nil {
+		traceEnd(span, err)
 		return
 	}
+	defer backendConn.Close()
 
-	id := strings.Split(target, ".")[0]
+	proxyForward(span, sessionId, id, tlsConn, backendConn)
+}
 
-	// Get the instance.
-	sessionId, _, instanceIP, _, _, _, err := dbGetInstance(id, true)
-	if err != nil || sessionId == -1 || instanceIP == "" {
+// proxyConn is a tracked client connection and its backend connection.
+type proxyConn struct {
+	client  net.Conn
+	backend net.Conn
+
+	lastActivity atomic.Int64
+}
+
+func (c *proxyConn) Close() {
+	_ = c.client.Close()
+	_ = c.backend.Close()
+}
+
+// Global variables.
+var (
+	proxyConnsLock sync.Mutex
+	proxyConns     = map[string]map[*proxyConn]struct{}{}
+	proxyConnCount int
+)
+
+// proxyTrack registers a connection against its session, enforcing the connection limits.
+func proxyTrack(id string, conn *proxyConn) bool {
+	proxyConnsLock.Lock()
+	defer proxyConnsLock.Unlock()
+
+	if config.Server.Proxy.Limits.Total > 0 && proxyConnCount >= config.Server.Proxy.Limits.Total {
+		return false
+	}
+
+	if config.Server.Proxy.Limits.Session > 0 && len(proxyConns[id]) >= config.Server.Proxy.Limits.Session {
+		return false
+	}
+
+	if proxyConns[id] == nil {
+		proxyConns[id] = map[*proxyConn]struct{}{}
+	}
+
+	proxyConns[id][conn] = struct{}{}
+	proxyConnCount++
+
+	return true
+}
+
+func proxyUntrack(id string, conn *proxyConn) {
+	proxyConnsLock.Lock()
+	defer proxyConnsLock.Unlock()
+
+	_, ok := proxyConns[id][conn]
+	if !ok {
 		return
 	}
 
-	// Connect to Incus.
-	backendConn, err := tls.Dial("tcp", net.JoinHostPort(instanceIP, "8443"), tlsConfig)
-	if err != nil {
+	delete(proxyConns[id], conn)
+	if len(proxyConns[id]) == 0 {
+		delete(proxyConns, id)
+	}
+
+	proxyConnCount--
+}
+
+// proxyForget closes all the proxied connections of an expired session.
+func proxyForget(id string) {
+	// Closing a connection makes its forwarder untrack it, so copy them first.
+	proxyConnsLock.Lock()
+	conns := make([]*proxyConn, 0, len(proxyConns[id]))
+	for conn := range proxyConns[id] {
+		conns = append(conns, conn)
+	}
+
+	proxyConnsLock.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// proxyForward tracks the connection and forwards data in both directions until both sides are done.
+func proxyForward(span trace.Span, sessionId int64, id string, clientConn net.Conn, backendConn net.Conn) {
+	conn := &proxyConn{client: clientConn, backend: backendConn}
+	conn.lastActivity.Store(time.Now().UnixNano())
+
+	if !proxyTrack(id, conn) {
+		traceEnd(span, fmt.Errorf("Connection limit reached"))
 		return
 	}
-	defer backendConn.Close()
+
+	defer proxyUntrack(id, conn)
+
+	// Apply the absolute timeout.
+	if config.Server.Proxy.Limits.Timeout > 0 {
+		timer := time.AfterFunc(time.Duration(config.Server.Proxy.Limits.Timeout)*time.Second, conn.Close)
+		defer timer.Stop()
+	}
+
+	var bytesIn int64
+	var bytesOut int64
 
 	var wg sync.WaitGroup
 	wg.Add(2)
 
 	go func() {
-		io.Copy(tlsConn, backendConn)
-		tlsConn.CloseWrite()
+		bytesOut = proxyCopy(conn, clientConn, backendConn)
 		wg.Done()
 	}()
 
 	go func() {
-		io.Copy(backendConn, tlsConn)
-		backendConn.CloseWrite()
+		bytesIn = proxyCopy(conn, backendConn, clientConn)
 		wg.Done()
 	}()
 
 	wg.Wait()
+
+	// Record the traffic.
+	metricProxyBytes.add("in", float64(bytesIn))
+	metricProxyBytes.add("out", float64(bytesOut))
+
+	span.SetAttributes(attribute.Int64("proxy.bytes_in", bytesIn), attribute.Int64("proxy.bytes_out", bytesOut))
+	span.End()
+
+	err := dbAddProxyBytes(sessionId, bytesIn, bytesOut)
+	if err != nil {
+		slog.Error("Failed to record proxy traffic", logSession, id, logError, err)
+	}
+}
+
+// proxyCopy copies data from src to dst until EOF, an error or the connection going idle.
+func proxyCopy(conn *proxyConn, dst net.Conn, src net.Conn) int64 {
+	type closeWriter interface {
+		CloseWrite() error
+	}
+
+	defer func() {
+		cw, ok := dst.(closeWriter)
+		if ok {
+			cw.CloseWrite()
+		}
+	}()
+
+	idleTimeout := time.Duration(config.Server.Proxy.Limits.IdleTimeout) * time.Second
+
+	var total int64
+	buf := make([]byte, 32*1024)
+	for {
+		if idleTimeout > 0 {
+			_ = src.SetReadDeadline(time.Now().Add(idleTimeout))
+		}
+
+		n, err := src.Read(buf)
+		if n > 0 {
+			conn.lastActivity.Store(time.Now().UnixNano())
+
+			_, errWrite := dst.Write(buf[:n])
+			if errWrite != nil {
+				return total
+			}
+
+			total += int64(n)
+		}
+
+		if err != nil {
+			// Only give up on timeout if the other direction is idle too.
+			netErr, ok := err.(net.Error)
+			if ok && netErr.Timeout() && time.Since(time.Unix(0, conn.lastActivity.Load())) < idleTimeout {
+				continue
+			}
+
+			if ok && netErr.Timeout() {
+				conn.Close()
+			}
+
+			return total
+		}
+	}
+}
+
+// proxyGetMapping returns the configured mapping matching the target name.
+func proxyGetMapping(target string) *proxyMapping {
+	if len(config.Server.Proxy.Mappings) == 0 {
+		return &proxyDefaultMapping
+	}
+
+	// The session ID is always the first label, the rest of the name selects the mapping.
+	_, suffix, _ := strings.Cut(strings.ToLower(target), ".")
+
+	for i, mapping := range config.Server.Proxy.Mappings {
+		_, mappingSuffix, _ := strings.Cut(strings.ToLower(mapping.Name), ".")
+		if mappingSuffix == suffix {
+			return &config.Server.Proxy.Mappings[i]
+		}
+	}
+
+	return nil
+}
+
+// proxyPeekServerName reads the SNI name from the TLS ClientHello and returns a connection replaying it.
+func proxyPeekServerName(conn net.Conn) (string, net.Conn, error) {
+	var serverName string
+	peeked := &bytes.Buffer{}
+
+	tlsConfig := &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = info.ServerName
+			return nil, errProxyPeeked
+		},
+	}
+
+	err := tls.Server(&proxyPeekConn{Conn: conn, reader: io.TeeReader(conn, peeked)}, tlsConfig).Handshake()
+	if !errors.Is(err, errProxyPeeked) {
+		if err == nil {
+			err = fmt.Errorf("Unexpected handshake completion")
+		}
+
+		return "", nil, err
+	}
+
+	return serverName, &proxyPeekConn{Conn: conn, reader: io.MultiReader(peeked, conn), write: true}, nil
+}
+
+// proxyPeekConn overrides the reads (and optionally blocks the writes) of a connection.
+type proxyPeekConn struct {
+	net.Conn
+	reader io.Reader
+	write  bool
+}
+
+func (c *proxyPeekConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *proxyPeekConn) Write(p []byte) (int, error) {
+	if !c.write {
+		return 0, io.ErrClosedPipe
+	}
+
+	return c.Conn.Write(p)
+}
+
+func (c *proxyPeekConn) CloseWrite() error {
+	tcpConn, ok := c.Conn.(*net.TCPConn)
+	if ok {
+		return tcpConn.CloseWrite()
+	}
+
+	return nil
+}
+
+// proxyGetInstanceIP returns the address of the instance backing an active session.
+func proxyGetInstanceIP(id string) (int64, string, error) {
+	sessionId, _, instanceIP, _, _, _, err := dbGetInstance(id, true)
+	if err != nil {
+		return -1, "", err
+	}
+
+	if sessionId == -1 || instanceIP == "" {
+		return -1, "", fmt.Errorf("Session not found")
+	}
+
+	return sessionId, instanceIP, nil
 }
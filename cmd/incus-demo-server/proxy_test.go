@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestProxyGetMapping(t *testing.T) {
+	previous := config
+	t.Cleanup(func() { config = previous })
+
+	mappings := []proxyMapping{
+		{Name: "{uuid}.incus.example.com", Port: 8443, TLS: proxyTLSTerminate, BackendTLS: true},
+		{Name: "{uuid}.ssh.example.com", Port: 22, TLS: proxyTLSPassthrough},
+	}
+
+	tests := []struct {
+		name     string
+		mappings []proxyMapping
+		target   string
+		want     *proxyMapping
+	}{
+		{name: "default", target: "anything", want: &proxyDefaultMapping},
+		{name: "first mapping", mappings: mappings, target: "0b7ac1b4.incus.example.com", want: &mappings[0]},
+		{name: "second mapping", mappings: mappings, target: "0b7ac1b4.ssh.example.com", want: &mappings[1]},
+		{name: "mixed case", mappings: mappings, target: "0B7AC1B4.SSH.Example.com", want: &mappings[1]},
+		{name: "unknown domain", mappings: mappings, target: "0b7ac1b4.example.com", want: nil},
+		{name: "extra label", mappings: mappings, target: "www.0b7ac1b4.incus.example.com", want: nil},
+		{name: "bare session", mappings: mappings, target: "0b7ac1b4", want: nil},
+		{name: "empty", mappings: mappings, target: "", want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Server.Proxy.Mappings = tt.mappings
+
+			got := proxyGetMapping(tt.target)
+			if tt.want == nil {
+				if got != nil {
+					t.Fatalf("proxyGetMapping(%q) = %q, expected no mapping", tt.target, got.Name)
+				}
+
+				return
+			}
+
+			if got == nil || *got != *tt.want {
+				t.Fatalf("proxyGetMapping(%q) = %v, expected %q", tt.target, got, tt.want.Name)
+			}
+		})
+	}
+}
+
+func TestProxyPeekServerName(t *testing.T) {
+	tests := []struct {
+		name       string
+		serverName string
+	}{
+		{name: "session name", serverName: "0b7ac1b4.incus.example.com"},
+		{name: "no SNI", serverName: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+
+			_ = server.SetDeadline(time.Now().Add(5 * time.Second))
+
+			go func() {
+				_ = tls.Client(client, &tls.Config{ServerName: tt.serverName, InsecureSkipVerify: true}).Handshake()
+			}()
+
+			got, conn, err := proxyPeekServerName(server)
+			if err != nil {
+				t.Fatalf("proxyPeekServerName failed: %v", err)
+			}
+
+			if got != tt.serverName {
+				t.Fatalf("proxyPeekServerName = %q, expected %q", got, tt.serverName)
+			}
+
+			// The ClientHello must be replayed to whoever reads the connection next.
+			header := make([]byte, 1)
+			_, err = io.ReadFull(conn, header)
+			if err != nil {
+				t.Fatalf("Failed to read the replayed handshake: %v", err)
+			}
+
+			if header[0] != 0x16 {
+				t.Fatalf("Replayed data starts with %#x, expected a TLS handshake record", header[0])
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"io"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
@@ -66,3 +67,45 @@ func (w *wsWrapper) Write(p []byte) (int, error) {
 
 	return len(p), nil
 }
+
+// SetWriteDeadline sets the deadline for the following writes.
+func (w *wsWrapper) SetWriteDeadline(t time.Time) error {
+	w.muw.Lock()
+	defer w.muw.Unlock()
+
+	return w.conn.SetWriteDeadline(t)
+}
+
+func (w *wsWrapper) Close() error {
+	return w.close(websocket.CloseNormalClosure, "")
+}
+
+// CloseWithMessage lets the client know why the connection is going away.
+func (w *wsWrapper) CloseWithMessage(message string) error {
+	return w.close(websocket.CloseGoingAway, message)
+}
+
+func (w *wsWrapper) close(code int, message string) error {
+	w.muw.Lock()
+	defer w.muw.Unlock()
+
+	// Let the client know we're going away.
+	_ = w.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, message), time.Now().Add(time.Second))
+
+	return w.conn.Close()
+}
+
+// consoleRWC implements ReadWriteCloser on top of a separate reader and writer.
+type consoleRWC struct {
+	io.Reader
+	io.Writer
+}
+
+func (c *consoleRWC) Close() error {
+	closer, ok := c.Writer.(io.Closer)
+	if ok {
+		return closer.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/yaml.v3"
+)
+
+// scenario is a guided tutorial, loaded from a scenario.yaml file and its Markdown steps.
+type scenario struct {
+	Name        string         `yaml:"-" json:"name"`
+	Title       string         `yaml:"title" json:"title"`
+	Description string         `yaml:"description" json:"description"`
+	Flavor      string         `yaml:"flavor" json:"flavor"`
+	Steps       []scenarioStep `yaml:"steps" json:"steps"`
+}
+
+// scenarioStep is a single step of a scenario, its content is either inline or read from a file.
+type scenarioStep struct {
+	Title   string `yaml:"title" json:"title"`
+	File    string `yaml:"file" json:"-"`
+	Content string `yaml:"content" json:"content"`
+
+	// Check is a shell command run in the instance, the step passes when it exits 0.
+	Check    string `yaml:"check" json:"-"`
+	HasCheck bool   `yaml:"-" json:"check"`
+}
+
+var scenarioNameRegex = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]*$`)
+
+// Global variables.
+var (
+	scenariosLock sync.RWMutex
+	scenarios     = map[string]*scenario{}
+)
+
+// scenarioGet returns the named scenario (nil if it doesn't exist).
+func scenarioGet(name string) *scenario {
+	scenariosLock.RLock()
+	defer scenariosLock.RUnlock()
+
+	return scenarios[name]
+}
+
+// scenarioList returns all scenarios sorted by name.
+func scenarioList() []*scenario {
+	scenariosLock.RLock()
+	defer scenariosLock.RUnlock()
+
+	entries := make([]*scenario, 0, len(scenarios))
+	for _, entry := range scenarios {
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+
+	return entries
+}
+
+// scenarioLoadAll (re-)loads all scenarios from the configured directory, skipping the broken ones.
+func scenarioLoadAll() error {
+	loaded := map[string]*scenario{}
+
+	if config.Server.Scenarios.Path != "" {
+		dirEntries, err := os.ReadDir(config.Server.Scenarios.Path)
+		if errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("Scenarios directory doesn't exist, no scenarios available", "path", config.Server.Scenarios.Path)
+		} else if err != nil {
+			return fmt.Errorf("Unable to read the scenarios: %w", err)
+		}
+
+		for _, dirEntry := range dirEntries {
+			if !dirEntry.IsDir() || !scenarioNameRegex.MatchString(dirEntry.Name()) {
+				continue
+			}
+
+			entry, err := scenarioLoad(filepath.Join(config.Server.Scenarios.Path, dirEntry.Name()))
+			if err != nil {
+				slog.Error("Unable to load the scenario", "scenario", dirEntry.Name(), logError, err)
+				continue
+			}
+
+			loaded[entry.Name] = entry
+		}
+	}
+
+	scenariosLock.Lock()
+	scenarios = loaded
+	scenariosLock.Unlock()
+
+	return nil
+}
+
+// scenarioLoad parses a scenario directory.
+func scenarioLoad(path string) (*scenario, error) {
+	data, err := os.ReadFile(filepath.Join(path, "scenario.yaml"))
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &scenario{}
+	err = yaml.Unmarshal(data, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	entry.Name = filepath.Base(path)
+
+	if entry.Title == "" {
+		return nil, fmt.Errorf("Missing title")
+	}
+
+	if len(entry.Steps) == 0 {
+		return nil, fmt.Errorf("No steps defined")
+	}
+
+	for i, step := range entry.Steps {
+		if step.File != "" {
+			if step.Content != "" {
+				return nil, fmt.Errorf("Step %d has both a file and inline content", i+1)
+			}
+
+			if filepath.IsAbs(step.File) || !filepath.IsLocal(step.File) {
+				return nil, fmt.Errorf("Step %d file must be within the scenario directory", i+1)
+			}
+
+			content, err := os.ReadFile(filepath.Join(path, step.File))
+			if err != nil {
+				return nil, err
+			}
+
+			entry.Steps[i].Content = string(content)
+		}
+
+		if entry.Steps[i].Content == "" {
+			return nil, fmt.Errorf("Step %d has no content", i+1)
+		}
+
+		entry.Steps[i].HasCheck = step.Check != ""
+	}
+
+	return entry, nil
+}
+
+// scenarioWatch adds the scenario directories to the configuration watcher.
+func scenarioWatch(watcher *fsnotify.Watcher) {
+	if config.Server.Scenarios.Path == "" {
+		return
+	}
+
+	err := watcher.Add(config.Server.Scenarios.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	} else if err != nil {
+		slog.Error("Unable to watch the scenarios", logError, err)
+		return
+	}
+
+	dirEntries, err := os.ReadDir(config.Server.Scenarios.Path)
+	if err != nil {
+		return
+	}
+
+	for _, dirEntry := range dirEntries {
+		if !dirEntry.IsDir() {
+			continue
+		}
+
+		err := watcher.Add(filepath.Join(config.Server.Scenarios.Path, dirEntry.Name()))
+		if err != nil {
+			slog.Error("Unable to watch the scenario", "scenario", dirEntry.Name(), logError, err)
+		}
+	}
+}
+
+// scenarioIsWatched returns whether the path is part of the scenarios.
+func scenarioIsWatched(path string) bool {
+	if config.Server.Scenarios.Path == "" {
+		return false
+	}
+
+	rel, err := filepath.Rel(config.Server.Scenarios.Path, path)
+	if err != nil {
+		return false
+	}
+
+	return filepath.IsLocal(rel)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestScenarioLoad(t *testing.T) {
+	tests := []struct {
+		name       string
+		files      map[string]string
+		wantFlavor string
+		wantSteps  []scenarioStep
+		wantErr    bool
+	}{
+		{
+			name: "inline steps",
+			files: map[string]string{"scenario.yaml": `title: Intro
+flavor: vm
+steps:
+  - title: First
+    content: Hello
+  - title: Second
+    content: World
+    check: test -e /root/done
+`},
+			wantFlavor: "vm",
+			wantSteps: []scenarioStep{
+				{Title: "First", Content: "Hello"},
+				{Title: "Second", Content: "World", Check: "test -e /root/done", HasCheck: true},
+			},
+		},
+		{
+			name: "step from a file",
+			files: map[string]string{
+				"scenario.yaml":  "title: Intro\nsteps:\n  - title: First\n    file: steps/first.md\n",
+				"steps/first.md": "# First\n",
+			},
+			wantSteps: []scenarioStep{
+				{Title: "First", File: "steps/first.md", Content: "# First\n"},
+			},
+		},
+		{name: "missing scenario.yaml", files: map[string]string{}, wantErr: true},
+		{name: "invalid YAML", files: map[string]string{"scenario.yaml": "title: [\n"}, wantErr: true},
+		{name: "missing title", files: map[string]string{"scenario.yaml": "steps:\n  - content: Hello\n"}, wantErr: true},
+		{name: "no steps", files: map[string]string{"scenario.yaml": "title: Intro\n"}, wantErr: true},
+		{name: "empty step", files: map[string]string{"scenario.yaml": "title: Intro\nsteps:\n  - title: First\n"}, wantErr: true},
+		{
+			name: "file and content",
+			files: map[string]string{
+				"scenario.yaml": "title: Intro\nsteps:\n  - file: first.md\n    content: Hello\n",
+				"first.md":      "Hello",
+			},
+			wantErr: true,
+		},
+		{name: "missing file", files: map[string]string{"scenario.yaml": "title: Intro\nsteps:\n  - file: first.md\n"}, wantErr: true},
+		{name: "absolute file", files: map[string]string{"scenario.yaml": "title: Intro\nsteps:\n  - file: /etc/passwd\n"}, wantErr: true},
+		{name: "file outside the directory", files: map[string]string{"scenario.yaml": "title: Intro\nsteps:\n  - file: ../secret.md\n"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "intro")
+
+			err := os.MkdirAll(path, 0755)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The file a step shouldn't be able to reach.
+			err = os.WriteFile(filepath.Join(path, "..", "secret.md"), []byte("Secret"), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for name, content := range tt.files {
+				err := os.MkdirAll(filepath.Dir(filepath.Join(path, name)), 0755)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				err = os.WriteFile(filepath.Join(path, name), []byte(content), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			entry, err := scenarioLoad(path)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("scenarioLoad succeeded, expected an error")
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("scenarioLoad failed: %v", err)
+			}
+
+			if entry.Name != "intro" {
+				t.Fatalf("Scenario name is %q, expected %q", entry.Name, "intro")
+			}
+
+			if entry.Flavor != tt.wantFlavor {
+				t.Fatalf("Scenario flavor is %q, expected %q", entry.Flavor, tt.wantFlavor)
+			}
+
+			if len(entry.Steps) != len(tt.wantSteps) {
+				t.Fatalf("Got %d steps, expected %d", len(entry.Steps), len(tt.wantSteps))
+			}
+
+			for i, step := range entry.Steps {
+				if step != tt.wantSteps[i] {
+					t.Fatalf("Step %d is %+v, expected %+v", i+1, step, tt.wantSteps[i])
+				}
+			}
+		})
+	}
+}
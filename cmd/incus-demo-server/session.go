@@ -1,7 +1,10 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"log/slog"
+	"math"
 	"strings"
 	"slices"
 	"sync"
@@ -10,6 +13,8 @@ import (
 	"github.com/lxc/incus/v6/client"
 	"github.com/lxc/incus/v6/shared/api"
 	"github.com/pborman/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // muCreate is used to allow performing operations that require no new instances be created.
@@ -24,36 +29,59 @@ const (
 	instanceQuotaReached statusCode = 3
 	instanceUserBanned   statusCode = 4
 	instanceUnknownError statusCode = 5
+	instanceDraining     statusCode = 6
+	instanceMaintenance  statusCode = 7
 )
 
-func instanceCreate(allocate bool, statusUpdate func(string)) (map[string]any, error) {
+// Reasons for a session to end.
+const (
+	sessionEndExpired     = "expired"
+	sessionEndIdle        = "idle"
+	sessionEndMaintenance = "maintenance"
+)
+
+func instanceCreate(ctx context.Context, allocate bool, request instanceRequest, statusUpdate func(string)) (map[string]any, error) {
 	muCreate.RLock()
 	defer muCreate.RUnlock()
 
 	info := map[string]any{}
 
+	flavor := flavorGet(request.flavor)
+	if flavor == nil {
+		return nil, fmt.Errorf("Unknown flavor %q", request.flavor)
+	}
+
 	// Create the instance.
 	if statusUpdate != nil {
 		statusUpdate("Creating the instance")
 	}
 
+	stageStart := time.Now()
+
 	id := uuid.NewRandom().String()
 	instanceName := fmt.Sprintf("tryit-%s", id)
 	instanceUsername := "admin"
 	instancePassword := uuid.NewRandom().String()
 
-	if config.Instance.Source.Instance != "" {
+	ctx, span := tracer.Start(ctx, "instance.create", trace.WithAttributes(traceSession.String(id), traceInstance.String(instanceName)))
+	defer span.End()
+
+	stageCtx, stageSpan := traceStageStart(ctx, "create", instanceName)
+	d := incusWithContext(incusDaemon, stageCtx)
+
+	if flavor.instance != "" {
 		args := incus.InstanceCopyArgs{
 			Name:         instanceName,
 			InstanceOnly: true,
 		}
 
-		source, _, err := incusDaemon.GetInstance(config.Instance.Source.Instance)
+		source, _, err := d.GetInstance(flavor.instance)
 		if err != nil {
+			traceEnd(stageSpan, err)
 			return nil, err
 		}
 
-		source.Profiles = config.Instance.Profiles
+		source.Profiles = flavor.Profiles
 
 		// Setup volatile.
 		for k := range source.Config {
@@ -65,13 +93,15 @@ func instanceCreate(allocate bool, statusUpdate func(string)) (map[string]any, e
 		}
 		source.Config["volatile.apply_template"] = "copy"
 
-		rop, err := incusDaemon.CopyInstance(incusDaemon, *source, &args)
+		rop, err := d.CopyInstance(d, *source, &args)
 		if err != nil {
+			traceEnd(stageSpan, err)
 			return nil, err
 		}
 
 		err = rop.Wait()
 		if err != nil {
+			traceEnd(stageSpan, err)
 			return nil, err
 		}
 	} else {
@@ -79,33 +109,43 @@ func instanceCreate(allocate bool, statusUpdate func(string)) (map[string]any, e
 			Name: instanceName,
 			Source: api.InstanceSource{
 				Type:     "image",
-				Alias:    config.Instance.Source.Image,
+				Alias:    flavor.Image,
 				Server:   "https://images.linuxcontainers.org",
 				Protocol: "simplestreams",
 			},
-			Type: api.InstanceType(config.Instance.Source.InstanceType),
+			Type: api.InstanceType(flavor.Type),
 		}
-		req.Profiles = config.Instance.Profiles
+		req.Profiles = flavor.Profiles
 
-		rop, err := incusDaemon.CreateInstance(req)
+		rop, err := d.CreateInstance(req)
 		if err != nil {
+			traceEnd(stageSpan, err)
 			return nil, err
 		}
 
 		err = rop.Wait()
 		if err != nil {
+			traceEnd(stageSpan, err)
 			return nil, err
 		}
 	}
 
+	metricStageDuration.observeSince("create", stageStart)
+	traceEnd(stageSpan, nil)
+
 	// Configure the instance devices.
 	if statusUpdate != nil {
 		statusUpdate("Configuring the instance")
 	}
 
-	ct, etag, err := incusDaemon.GetInstance(instanceName)
+	stageStart = time.Now()
+	stageCtx, stageSpan = traceStageStart(ctx, "configure", instanceName)
+	d = incusWithContext(incusDaemon, stageCtx)
+
+	ct, etag, err := d.GetInstance(instanceName)
 	if err != nil {
-		incusForceDelete(incusDaemon, instanceName)
+		traceEnd(stageSpan, err)
+		incusForceDelete(d, instanceName)
 		return nil, err
 	}
 
@@ -136,7 +176,34 @@ func instanceCreate(allocate bool, statusUpdate func(string)) (map[string]any, e
 		ct.Config["limits.memory"] = config.Instance.Limits.Memory
 	}
 
-	if !config.Session.ConsoleOnly {
+	// Render the cloud-init configuration.
+	vars := cloudInitVars{
+		Username: instanceUsername,
+		Password: instancePassword,
+		UUID:     id,
+		Expiry:   request.expiry,
+		Protocol: request.protocol,
+		Flavor:   flavor.Name,
+	}
+
+	for key, tpl := range map[string]cloudInitTemplate{
+		"user.user-data":      config.Instance.CloudInit.UserData,
+		"user.vendor-data":    config.Instance.CloudInit.VendorData,
+		"user.network-config": config.Instance.CloudInit.NetworkConfig,
+	} {
+		value, err := cloudInitRender(tpl, vars)
+		if err != nil {
+			traceEnd(stageSpan, err)
+			incusForceDelete(d, instanceName)
+			return nil, err
+		}
+
+		if value != "" {
+			ct.Config[key] = value
+		}
+	}
+
+	if !config.Session.ConsoleOnly && ct.Config["user.user-data"] == "" {
 		ct.Config["user.user-data"] = fmt.Sprintf(`#cloud-config
 ssh_pwauth: True
 manage_etc_hosts: True
@@ -149,25 +216,51 @@ users:
 `, instanceUsername, instancePassword)
 	}
 
-	op, err := incusDaemon.UpdateInstance(instanceName, ct.Writable(), etag)
+	op, err := d.UpdateInstance(instanceName, ct.Writable(), etag)
 	if err != nil {
-		incusForceDelete(incusDaemon, instanceName)
+		traceEnd(stageSpan, err)
+		incusForceDelete(d, instanceName)
 		return nil, err
 	}
 
 	err = op.Wait()
 	if err != nil {
-		incusForceDelete(incusDaemon, instanceName)
+		traceEnd(stageSpan, err)
+		incusForceDelete(d, instanceName)
 		return nil, err
 	}
 
+	metricStageDuration.observeSince("configure", stageStart)
+	traceEnd(stageSpan, nil)
+
 	// Start the instance.
-	instanceIP, err := instanceStart(instanceName, statusUpdate)
+	instanceIP, err := instanceStart(ctx, instanceName, statusUpdate)
 	if err != nil {
 		incusForceDelete(incusDaemon, instanceName)
 		return nil, err
 	}
 
+	// Record the initial state so the user can reset the instance.
+	if config.Session.Snapshots.Reset {
+		stageStart := time.Now()
+		stageCtx, stageSpan := traceStageStart(ctx, "snapshot", instanceName)
+		d := incusWithContext(incusDaemon, stageCtx)
+
+		op, err := d.CreateInstanceSnapshot(instanceName, api.InstanceSnapshotsPost{Name: snapshotPristine})
+		if err == nil {
+			err = op.Wait()
+		}
+
+		if err != nil {
+			traceEnd(stageSpan, err)
+			incusForceDelete(d, instanceName)
+			return nil, err
+		}
+
+		metricStageDuration.observeSince("snapshot", stageStart)
+		traceEnd(stageSpan, nil)
+	}
+
 	// Return to the client.
 	info["username"] = ""
 	info["password"] = ""
@@ -185,11 +278,13 @@ users:
 	return info, nil
 }
 
-func instanceStart(instanceName string, statusUpdate func(string)) (string, error) {
+func instanceStart(ctx context.Context, instanceName string, statusUpdate func(string)) (string, error) {
+	d := incusWithContext(incusDaemon, ctx)
+
 	// Check if already started.
-	ct, _, err := incusDaemon.GetInstance(instanceName)
+	ct, _, err := d.GetInstance(instanceName)
 	if err != nil {
-		incusForceDelete(incusDaemon, instanceName)
+		incusForceDelete(d, instanceName)
 		return "", err
 	}
 
@@ -202,24 +297,36 @@ func instanceStart(instanceName string, statusUpdate func(string)) (string, erro
 		statusUpdate("Starting the instance")
 	}
 
+	stageStart := time.Now()
+	stageCtx, stageSpan := traceStageStart(ctx, "start", instanceName)
+	d = incusWithContext(incusDaemon, stageCtx)
+
 	req := api.InstanceStatePut{
 		Action:  "start",
 		Timeout: -1,
 	}
 
-	op, err := incusDaemon.UpdateInstanceState(instanceName, req, "")
+	op, err := d.UpdateInstanceState(instanceName, req, "")
 	if err != nil {
-		incusForceDelete(incusDaemon, instanceName)
+		traceEnd(stageSpan, err)
+		incusForceDelete(d, instanceName)
 		return "", err
 	}
 
 	err = op.Wait()
 	if err != nil {
-		incusForceDelete(incusDaemon, instanceName)
+		traceEnd(stageSpan, err)
+		incusForceDelete(d, instanceName)
 		return "", err
 	}
 
-	// Get the IP (30s timeout).
+	metricStageDuration.observeSince("start", stageStart)
+	traceEnd(stageSpan, nil)
+
+	// Get the IP.
+	stageStart = time.Now()
+	stageCtx, stageSpan = traceStageStart(ctx, "network", instanceName)
+	d = incusWithContext(incusDaemon, stageCtx)
 	time.Sleep(2 * time.Second)
 
 	if statusUpdate != nil {
@@ -227,12 +334,14 @@ func instanceStart(instanceName string, statusUpdate func(string)) (string, erro
 	}
 
 	var instanceIP string
-	timeout := 30
-	for timeout != 0 {
-		timeout--
-		instState, _, err := incusDaemon.GetInstanceState(instanceName)
+	attempts := 0
+	deadline := time.Now().Add(time.Duration(config.Session.NetworkTimeout) * time.Second)
+	for {
+		attempts++
+		instState, _, err := d.GetInstanceState(instanceName)
 		if err != nil {
-			incusForceDelete(incusDaemon, instanceName)
+			traceEnd(stageSpan, err)
+			incusForceDelete(d, instanceName)
 			return "", err
 		}
 
@@ -277,41 +386,170 @@ func instanceStart(instanceName string, statusUpdate func(string)) (string, erro
 			break
 		}
 
+		if time.Now().After(deadline) {
+			err := fmt.Errorf("Instance didn't get an IP address within %ds", config.Session.NetworkTimeout)
+			slog.Warn("Instance didn't get an IP address", logInstance, instanceName, logStage, "network")
+			stageSpan.SetAttributes(attribute.Int("network.attempts", attempts))
+			traceEnd(stageSpan, err)
+			incusForceDelete(d, instanceName)
+			return "", err
+		}
+
 		time.Sleep(1 * time.Second)
 	}
 
-	// Wait for ready command (if set).
-	if len(config.Session.ReadyCommand) > 0 {
-		timeout := 30
-		for timeout != 0 {
-			time.Sleep(time.Second)
-			timeout--
+	metricStageDuration.observeSince("network", stageStart)
+	stageSpan.SetAttributes(attribute.Int("network.attempts", attempts))
+	traceEnd(stageSpan, nil)
+
+	// Wait for the instance to be ready.
+	if len(config.Session.probes) > 0 {
+		stageStart = time.Now()
+		stageCtx, stageSpan := traceStageStart(ctx, "ready", instanceName)
+		d := incusWithContext(incusDaemon, stageCtx)
 
-			// Send the exec request.
-			req := api.InstanceExecPost{
-				Command:     config.Session.ReadyCommand,
-				WaitForWS:   false,
-				Interactive: false,
+		for _, probe := range config.Session.probes {
+			if statusUpdate != nil {
+				statusUpdate(probeDescription(probe))
 			}
 
-			op, err := incusDaemon.ExecInstance(instanceName, req, nil)
+			err := probeRun(stageCtx, d, instanceName, instanceIP, probe)
 			if err != nil {
-				continue
+				slog.Warn("Instance failed to become ready", logInstance, instanceName, logStage, "ready", logError, err)
+				traceEnd(stageSpan, err)
+				incusForceDelete(d, instanceName)
+				return "", err
 			}
+		}
 
-			_ = op.Wait()
+		metricStageDuration.observeSince("ready", stageStart)
+		traceEnd(stageSpan, nil)
+	}
 
-			opAPI := op.Get()
-			if opAPI.Metadata != nil {
-				exitStatusRaw, ok := opAPI.Metadata["return"].(float64)
-				if ok && exitStatusRaw == 0 {
-					break
-				}
-			}
+	return instanceIP, nil
+}
+
+// sessionSchedule sets up the expiry of a session along with the warnings leading to it.
+func sessionSchedule(sessionID int64, sessionUUID string, instanceName string, expiry int64) {
+	remaining := time.Until(time.Unix(expiry, 0))
+	if remaining <= 0 {
+		sessionExpire(sessionID, sessionUUID, instanceName, expiry)
+		return
+	}
+
+	for _, warning := range config.Session.ExpiryWarnings {
+		delay := remaining - time.Duration(warning)*time.Second
+		if delay < 0 {
+			continue
 		}
+
+		time.AfterFunc(delay, func() {
+			sessionWarn(sessionUUID, instanceName, expiry)
+		})
 	}
 
-	return instanceIP, nil
+	time.AfterFunc(remaining, func() {
+		sessionExpire(sessionID, sessionUUID, instanceName, expiry)
+	})
+}
+
+// sessionExpire ends the session unless its expiry was pushed back since it was scheduled.
+func sessionExpire(sessionID int64, sessionUUID string, instanceName string, expiry int64) {
+	sessionId, _, _, _, _, currentExpiry, err := dbGetInstance(sessionUUID, true)
+	if err == nil {
+		if sessionId == -1 {
+			return
+		}
+
+		// A new expiry was scheduled.
+		if currentExpiry > expiry {
+			return
+		}
+	}
+
+	// The expiry will be rescheduled once unfrozen.
+	if config.Session.Freeze.PauseExpiry && sessionIsFrozen(sessionID) {
+		return
+	}
+
+	sessionEnd(sessionID, sessionUUID, instanceName, sessionEndExpired)
+}
+
+// sessionWarn lets the user know that the session is about to expire.
+func sessionWarn(sessionUUID string, instanceName string, expiry int64) {
+	// Skip sessions which are already gone or were rescheduled.
+	sessionId, _, _, _, _, currentExpiry, err := dbGetInstance(sessionUUID, true)
+	if err != nil || sessionId == -1 || currentExpiry != expiry {
+		return
+	}
+
+	// Nobody is around to see it.
+	if config.Session.Freeze.PauseExpiry && sessionIsFrozen(sessionId) {
+		return
+	}
+
+	remaining := time.Until(time.Unix(expiry, 0))
+
+	message := fmt.Sprintf("This session will expire in %d minute(s), make sure to save your work.", int(math.Ceil(remaining.Minutes())))
+	if remaining < time.Minute {
+		message = fmt.Sprintf("This session will expire in %d second(s), make sure to save your work.", int(remaining.Seconds()))
+	}
+
+	consoleNotify(sessionUUID, message)
+
+	eventSend(sessionUUID, "expiry-warning", map[string]any{
+		"expiry":    expiry,
+		"remaining": int(remaining.Seconds()),
+		"message":   message,
+	})
+
+	// Also notify the users logged into the instance (a frozen one can't run anything and has nobody logged in).
+	if config.Session.ExpiryWall && !sessionIsFrozen(sessionId) {
+		req := api.InstanceExecPost{
+			Command: []string{"wall", message},
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), incusExecTimeout)
+		defer cancel()
+
+		exitCode, err := incusExecContext(ctx, incusDaemon, instanceName, req, nil, nil, nil)
+		if err != nil || exitCode != 0 {
+			slog.Warn("Failed to send the expiry warning", logSession, sessionUUID, logInstance, instanceName, "exit_code", exitCode, logError, err)
+		}
+	}
+}
+
+// sessionEnd deletes the instance backing a session and records why the session ended.
+func sessionEnd(sessionID int64, sessionUUID string, instanceName string, reason string) {
+	ended, err := dbExpire(sessionID, reason)
+	if err != nil {
+		slog.Error("Failed to expire the session", logSession, sessionUUID, logInstance, instanceName, logError, err)
+	} else if !ended {
+		// Already ended for another reason.
+		return
+	}
+
+	metricSessionEnds.inc(reason)
+	slog.Info("Session ended", logSession, sessionUUID, logInstance, instanceName, "reason", reason)
+
+	eventSend(sessionUUID, "session-ended", map[string]any{"reason": reason})
+
+	proxyForget(sessionUUID)
+
+	// Exports are bounded by their timeout but still shouldn't hold up the caller, the instance goes once done.
+	email := exportSessionEmail(sessionID)
+	if email != "" {
+		go func() {
+			exportSessionEnd(sessionID, sessionUUID, instanceName, email)
+			incusForceDelete(incusDaemon, instanceName)
+		}()
+	} else {
+		incusForceDelete(incusDaemon, instanceName)
+	}
+
+	webForget(sessionUUID)
+	execForget(sessionUUID)
+	activityForget(sessionUUID)
 }
 
 func instancePreAllocate() error {
@@ -321,11 +559,14 @@ func instancePreAllocate() error {
 		var err error
 
 		// Try to create the isntance.
-		info, err = instanceCreate(true, nil)
+		info, err = instanceCreate(context.Background(), true, instanceRequest{}, nil)
 		if err == nil {
 			break
 		}
 
+		metricCreateFailures.inc("")
+		slog.Error("Failed to pre-allocate instance, retrying in 30s", logError, err)
+
 		// Retry in 30s.
 		time.Sleep(30 * time.Second)
 	}
@@ -355,8 +596,16 @@ func instancePreAllocate() error {
 	time.AfterFunc(duration, func() {
 		if dbIsAllocated(instanceID) {
 			incusForceDelete(incusDaemon, info["name"].(string))
-			dbDelete(instanceID)
-			instancePreAllocate()
+
+			err := dbDelete(instanceID)
+			if err != nil {
+				slog.Error("Failed to delete the session record", logInstance, info["name"], logError, err)
+			}
+
+			err = instancePreAllocate()
+			if err != nil {
+				slog.Error("Failed to pre-allocate instance", logError, err)
+			}
 		}
 	})
 
@@ -368,6 +617,12 @@ func instanceResync() error {
 	muCreate.Lock()
 	defer muCreate.Unlock()
 
+	// Forget about playground runs which didn't clean up after themselves.
+	err := dbDeletePlaygroundExpired()
+	if err != nil {
+		return err
+	}
+
 	// List all existing instances.
 	instanceNames, err := incusDaemon.GetInstanceNames(api.InstanceTypeAny)
 	if err != nil {
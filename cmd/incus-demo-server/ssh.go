@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	sshCredentialSecret = "secret"
+	sshCredentialKey    = "key"
+)
+
+func sshListener() {
+	// Load or generate the host key.
+	var signer ssh.Signer
+	var err error
+
+	if config.Server.SSH.HostKey != "" {
+		signer, err = ssh.ParsePrivateKey([]byte(config.Server.SSH.HostKey))
+		if err != nil {
+			slog.Error("Failed to parse host key", "listener", "ssh", logError, err)
+			return
+		}
+	} else {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			slog.Error("Failed to generate host key", "listener", "ssh", logError, err)
+			return
+		}
+
+		signer, err = ssh.NewSignerFromKey(key)
+		if err != nil {
+			slog.Error("Failed to generate host key", "listener", "ssh", logError, err)
+			return
+		}
+	}
+
+	sshConfig := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			return sshAuthenticate(conn.User(), func(credType string, value string) bool {
+				return credType == sshCredentialSecret && subtle.ConstantTimeCompare([]byte(value), password) == 1
+			})
+		},
+
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			return sshAuthenticate(conn.User(), func(credType string, value string) bool {
+				if credType != sshCredentialKey {
+					return false
+				}
+
+				authorizedKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(value))
+				if err != nil {
+					return false
+				}
+
+				return bytes.Equal(authorizedKey.Marshal(), key.Marshal())
+			})
+		},
+	}
+
+	sshConfig.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", config.Server.SSH.Address)
+	if err != nil {
+		slog.Error("Failed to start listener", "listener", "ssh", logError, err)
+		return
+	}
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			continue
+		}
+
+		go sshHandle(conn, sshConfig)
+	}
+}
+
+// sshAuthenticate validates the session used as the SSH user against its recorded credentials.
+func sshAuthenticate(id string, match func(credType string, value string) bool) (*ssh.Permissions, error) {
+	if maintenanceEnabled() || incusDaemon == nil {
+		return nil, fmt.Errorf("Server in maintenance mode")
+	}
+
+	// Get the instance.
+	sessionId, instanceName, _, _, _, _, err := dbGetInstance(id, true)
+	if err != nil || sessionId == -1 {
+		return nil, fmt.Errorf("Session not found")
+	}
+
+	// Check the credentials.
+	credentials, err := dbGetSSHCredentials(sessionId)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range credentials {
+		if match(entry[0].(string), entry[1].(string)) {
+			return &ssh.Permissions{Extensions: map[string]string{"id": id, "instance": instanceName}}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Invalid credentials")
+}
+
+func sshHandle(conn net.Conn, sshConfig *ssh.ServerConfig) {
+	defer conn.Close()
+
+	sshConn, channels, reqs, err := ssh.NewServerConn(conn, sshConfig)
+	if err != nil {
+		return
+	}
+	defer sshConn.Close()
+
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "Only session channels are supported")
+			continue
+		}
+
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+
+		go sshHandleSession(sshConn.Permissions.Extensions["id"], sshConn.Permissions.Extensions["instance"], channel, requests)
+	}
+}
+
+func sshHandleSession(id string, instanceName string, channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+
+	activityConnect(id)
+	defer activityDisconnect(id)
+
+	width := 80
+	height := 24
+	var terminal *consoleTerminal
+
+	for req := range requests {
+		switch req.Type {
+		case "pty-req":
+			// Skip the terminal name, then read the dimensions.
+			if len(req.Payload) < 4 {
+				_ = req.Reply(false, nil)
+				continue
+			}
+
+			termLen := binary.BigEndian.Uint32(req.Payload)
+			payload := req.Payload[4:]
+			if uint32(len(payload)) < termLen+8 {
+				_ = req.Reply(false, nil)
+				continue
+			}
+
+			payload = payload[termLen:]
+			width = int(binary.BigEndian.Uint32(payload))
+			height = int(binary.BigEndian.Uint32(payload[4:]))
+
+			_ = req.Reply(true, nil)
+		case "window-change":
+			if len(req.Payload) < 8 {
+				_ = req.Reply(false, nil)
+				continue
+			}
+
+			width = int(binary.BigEndian.Uint32(req.Payload))
+			height = int(binary.BigEndian.Uint32(req.Payload[4:]))
+
+			if terminal != nil {
+				_ = terminal.resize(width, height)
+			}
+
+			_ = req.Reply(true, nil)
+		case "shell":
+			if terminal != nil {
+				_ = req.Reply(false, nil)
+				continue
+			}
+
+			// Resume the instance if it was frozen.
+			sessionId, _, _, _, _, _, err := dbGetInstance(id, true)
+			if err != nil || sessionId == -1 {
+				_ = req.Reply(false, nil)
+				return
+			}
+
+			err = sessionUnfreeze(sessionId, id, instanceName)
+			if err != nil {
+				slog.Error("Failed to unfreeze the session", logSession, id, logInstance, instanceName, logError, err)
+				_ = req.Reply(false, nil)
+				return
+			}
+
+			// Spawn a new terminal.
+			flavor, err := flavorSession(sessionId)
+			if err != nil {
+				_ = req.Reply(false, nil)
+				return
+			}
+
+			terminal = consoleNew(id, instanceName, flavor.ConsoleMode, false)
+			terminal.add(channel, 0, "")
+
+			err = terminal.start(width, height)
+			if err != nil {
+				_ = req.Reply(false, nil)
+				return
+			}
+
+			_ = req.Reply(true, nil)
+			go func() {
+				terminal.attach(channel)
+				_ = channel.Close()
+			}()
+		default:
+			_ = req.Reply(false, nil)
+		}
+	}
+}
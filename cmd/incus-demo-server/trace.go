@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	traceExporterOTLP   = "otlp"
+	traceExporterStdout = "stdout"
+	traceExporterFile   = "file"
+)
+
+// Global variables.
+var (
+	tracer         = otel.Tracer("incus-demo-server")
+	tracerProvider *sdktrace.TracerProvider
+)
+
+// Span attributes.
+var (
+	traceSession  = attribute.Key("session.id")
+	traceInstance = attribute.Key("instance.name")
+	traceStage    = attribute.Key("stage")
+)
+
+// traceSetup configures the trace exporter, tracing is disabled when no exporter is set.
+func traceSetup() error {
+	var exporter sdktrace.SpanExporter
+	var err error
+
+	switch config.Server.Tracing.Exporter {
+	case "":
+		return nil
+	case traceExporterOTLP:
+		opts := []otlptracehttp.Option{}
+		if config.Server.Tracing.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(config.Server.Tracing.Endpoint))
+		}
+
+		exporter, err = otlptracehttp.New(context.Background(), opts...)
+	case traceExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	case traceExporterFile:
+		if config.Server.Tracing.Path == "" {
+			return fmt.Errorf("A path is required for the file trace exporter")
+		}
+
+		var f *os.File
+		f, err = os.OpenFile(config.Server.Tracing.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("Unable to open the trace file: %w", err)
+		}
+
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(f))
+	default:
+		return fmt.Errorf("Invalid trace exporter %q", config.Server.Tracing.Exporter)
+	}
+
+	if err != nil {
+		return fmt.Errorf("Unable to setup the trace exporter: %w", err)
+	}
+
+	tracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName("incus-demo-server"))),
+	)
+
+	otel.SetTracerProvider(tracerProvider)
+
+	return nil
+}
+
+// traceStageStart starts a span for a stage of the instance creation.
+func traceStageStart(ctx context.Context, stage string, instanceName string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "instance."+stage, trace.WithAttributes(traceStage.String(stage), traceInstance.String(instanceName)))
+}
+
+// traceEnd records the outcome of the operation and ends the span.
+func traceEnd(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
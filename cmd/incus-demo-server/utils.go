@@ -1,11 +1,19 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"log/slog"
 	"net"
 	"net/http"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/lxc/incus/v6/client"
 	"github.com/lxc/incus/v6/shared/api"
 )
@@ -23,19 +31,137 @@ func incusForceDelete(d incus.InstanceServer, name string) error {
 	}
 
 	op, err = d.DeleteInstance(name)
+	if err == nil {
+		err = op.Wait()
+	}
+
 	if err != nil {
+		slog.Error("Failed to delete instance", logInstance, name, logError, err)
 		return err
 	}
 
-	return op.Wait()
+	return nil
 }
 
-func restStartError(w http.ResponseWriter, err error, code statusCode) {
+// incusExecTimeout bounds the short commands the server itself runs in instances.
+const incusExecTimeout = 30 * time.Second
+
+// incusExecContext runs a non-interactive command in the instance and returns its exit status, killing it when the context is done.
+func incusExecContext(ctx context.Context, d incus.InstanceServer, name string, req api.InstanceExecPost, stdin io.Reader, stdout io.Writer, stderr io.Writer) (int, error) {
+	req.WaitForWS = true
+	req.Interactive = false
+
+	if stdin == nil {
+		stdin = bytes.NewReader(nil)
+	}
+
+	control := make(chan *websocket.Conn, 1)
+	args := incus.InstanceExecArgs{
+		Stdin:    stdin,
+		Stdout:   stdout,
+		Stderr:   stderr,
+		DataDone: make(chan bool),
+		Control: func(conn *websocket.Conn) {
+			control <- conn
+
+			for {
+				_, _, err := conn.ReadMessage()
+				if err != nil {
+					break
+				}
+			}
+		},
+	}
+
+	op, err := d.ExecInstance(name, req, &args)
+	if err != nil {
+		return -1, err
+	}
+
+	// Kill the command if the context is done before it exits.
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+			return
+		}
+
+		select {
+		case conn := <-control:
+			_ = conn.WriteJSON(api.InstanceExecControl{Command: "signal", Signal: int(syscall.SIGKILL)})
+		case <-done:
+		}
+	}()
+
+	err = op.Wait()
+	if err != nil {
+		return -1, err
+	}
+
+	<-args.DataDone
+
+	opAPI := op.Get()
+	exitStatusRaw, ok := opAPI.Metadata["return"].(float64)
+	if !ok {
+		return -1, fmt.Errorf("Missing exit status")
+	}
+
+	return int(exitStatusRaw), nil
+}
+
+// limitWriter stops storing data past its limit, discarding the rest so the writer is never blocked.
+type limitWriter struct {
+	io.Writer
+
+	mu       sync.Mutex
+	limit    int64
+	size     int64
+	exceeded bool
+
+	// onExceeded is called once the limit is first reached.
+	onExceeded func()
+}
+
+func (w *limitWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	length := len(p)
+	if w.exceeded {
+		return length, nil
+	}
+
+	if w.limit > 0 && w.size+int64(len(p)) > w.limit {
+		w.exceeded = true
+		p = p[:w.limit-w.size]
+
+		if w.onExceeded != nil {
+			w.onExceeded()
+		}
+	}
+
+	n, err := w.Writer.Write(p)
+	w.size += int64(n)
+	if err != nil {
+		return n, err
+	}
+
+	return length, nil
+}
+
+func restStartError(w http.ResponseWriter, log *slog.Logger, err error, code statusCode) {
 	body := make(map[string]interface{})
 	body["status"] = code
 
+	metricStartRejected.inc(statusNames[code])
+
 	if err != nil {
-		fmt.Printf("error: %s\n", err)
+		log.Error("Failed to start session", "status", statusNames[code], logError, err)
+	} else {
+		log.Info("Session request rejected", "status", statusNames[code])
 	}
 
 	err = json.NewEncoder(w).Encode(body)
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type webTargetKey struct{}
+
+// webTarget is the session and port a request is being routed to.
+type webTarget struct {
+	id     string
+	port   int
+	addr   string
+	client string
+}
+
+// Global variables.
+var (
+	webLimitersLock sync.Mutex
+	webLimiters     = map[string]*rateLimiter{}
+)
+
+func webListener() {
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			target := r.In.Context().Value(webTargetKey{}).(*webTarget)
+
+			r.Out.URL.Scheme = "http"
+			r.Out.URL.Host = target.addr
+			r.SetXForwarded()
+		},
+
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+				target := ctx.Value(webTargetKey{}).(*webTarget)
+
+				dialer := net.Dialer{Timeout: 10 * time.Second}
+				conn, err := dialer.DialContext(ctx, network, addr)
+				if err != nil {
+					return nil, err
+				}
+
+				if config.Server.Web.Bandwidth <= 0 {
+					return conn, nil
+				}
+
+				return &rateLimitedConn{Conn: conn, limiter: webLimiter(target.id)}, nil
+			},
+			DisableKeepAlives: true,
+		},
+
+		ModifyResponse: func(resp *http.Response) error {
+			webLog(resp.Request, resp.StatusCode)
+			return nil
+		},
+
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			webLog(r, http.StatusBadGateway)
+			http.Error(w, "Unable to reach the instance", http.StatusBadGateway)
+		},
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Figure out the target name (SNI or Host).
+		name := r.Host
+		if r.TLS != nil && r.TLS.ServerName != "" {
+			name = r.TLS.ServerName
+		}
+
+		host, _, err := net.SplitHostPort(name)
+		if err == nil {
+			name = host
+		}
+
+		target, err := webGetTarget(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		target.client, _, err = restClientIP(r)
+		if err != nil {
+			target.client = r.RemoteAddr
+		}
+
+		proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), webTargetKey{}, target)))
+	})
+
+	server := &http.Server{Addr: config.Server.Web.Address, Handler: handler}
+
+	var err error
+	if config.Server.Web.Certificate != "" && config.Server.Web.Key != "" {
+		var cert tls.Certificate
+
+		cert, err = tls.X509KeyPair([]byte(config.Server.Web.Certificate), []byte(config.Server.Web.Key))
+		if err != nil {
+			slog.Error("Failed to load TLS certificate", "listener", "web", logError, err)
+			return
+		}
+
+		server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+
+	if err != nil {
+		slog.Error("Failed to start listener", "listener", "web", logError, err)
+		return
+	}
+}
+
+// webGetTarget parses a {session-uuid}-{port}.<domain> name and resolves it to an instance address.
+func webGetTarget(name string) (*webTarget, error) {
+	id, port, err := webParseName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get the instance.
+	_, instanceIP, err := proxyGetInstanceIP(id)
+	if err != nil {
+		return nil, fmt.Errorf("Session not found")
+	}
+
+	return &webTarget{id: id, port: port, addr: net.JoinHostPort(instanceIP, strconv.Itoa(port))}, nil
+}
+
+// webParseName splits a {session-uuid}-{port}.<domain> name into the session ID and an allowed port.
+func webParseName(name string) (string, int, error) {
+	name = strings.ToLower(name)
+
+	prefix, found := strings.CutSuffix(name, "."+strings.ToLower(config.Server.Web.Domain))
+	if !found || strings.Contains(prefix, ".") {
+		return "", 0, fmt.Errorf("Unknown domain")
+	}
+
+	pos := strings.LastIndex(prefix, "-")
+	if pos <= 0 {
+		return "", 0, fmt.Errorf("Invalid name")
+	}
+
+	id := prefix[:pos]
+	port, err := strconv.Atoi(prefix[pos+1:])
+	if err != nil {
+		return "", 0, fmt.Errorf("Invalid port")
+	}
+
+	if !slices.Contains(config.Server.Web.Ports, port) {
+		return "", 0, fmt.Errorf("Port isn't allowed")
+	}
+
+	return id, port, nil
+}
+
+// webLimiter returns the bandwidth limiter for the session.
+func webLimiter(id string) *rateLimiter {
+	webLimitersLock.Lock()
+	defer webLimitersLock.Unlock()
+
+	limiter, ok := webLimiters[id]
+	if !ok {
+		limiter = newRateLimiter(config.Server.Web.Bandwidth)
+		webLimiters[id] = limiter
+	}
+
+	return limiter
+}
+
+// webForget releases the bandwidth limiter of an expired session.
+func webForget(id string) {
+	webLimitersLock.Lock()
+	defer webLimitersLock.Unlock()
+
+	delete(webLimiters, id)
+}
+
+func webLog(r *http.Request, status int) {
+	target, ok := r.Context().Value(webTargetKey{}).(*webTarget)
+	if !ok {
+		return
+	}
+
+	slog.Info("Web request", logSession, target.id, logClient, target.client, "method", r.Method, "path", r.URL.RequestURI(), "port", target.port, "status", status)
+}
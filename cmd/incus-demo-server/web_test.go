@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestWebParseName(t *testing.T) {
+	previous := config
+	t.Cleanup(func() { config = previous })
+
+	config.Server.Web.Domain = "Web.Example.com"
+	config.Server.Web.Ports = []int{80, 8080}
+
+	id := "0b7ac1b4-5a2e-4a4f-9a59-7e2c3b8f1d2e"
+
+	tests := []struct {
+		name     string
+		host     string
+		wantID   string
+		wantPort int
+		wantErr  bool
+	}{
+		{name: "valid", host: id + "-8080.web.example.com", wantID: id, wantPort: 8080},
+		{name: "mixed case", host: "0B7AC1B4-5A2E-4A4F-9A59-7E2C3B8F1D2E-80.WEB.example.COM", wantID: id, wantPort: 80},
+		{name: "other domain", host: id + "-80.example.com", wantErr: true},
+		{name: "domain suffix only", host: id + "-80web.example.com", wantErr: true},
+		{name: "extra label", host: "www." + id + "-80.web.example.com", wantErr: true},
+		{name: "bare domain", host: "web.example.com", wantErr: true},
+		{name: "missing port", host: "session.web.example.com", wantErr: true},
+		{name: "missing id", host: "-80.web.example.com", wantErr: true},
+		{name: "invalid port", host: id + "-http.web.example.com", wantErr: true},
+		{name: "port not allowed", host: id + "-22.web.example.com", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotID, gotPort, err := webParseName(tt.host)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("webParseName(%q) = %q, %d, expected an error", tt.host, gotID, gotPort)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("webParseName(%q) failed: %v", tt.host, err)
+			}
+
+			if gotID != tt.wantID || gotPort != tt.wantPort {
+				t.Fatalf("webParseName(%q) = %q, %d, expected %q, %d", tt.host, gotID, gotPort, tt.wantID, tt.wantPort)
+			}
+		})
+	}
+}
@@ -6,7 +6,21 @@ $(document).ready(function() {
     var tryit_server_websocket = "ws://" + tryit_server
     var original_url = window.location.href.split("?")[0];
     var term = null
+    var fitAddon = null
     var sock = null
+    var events = null
+
+    function showAnnouncement(severity, message) {
+        var level = "info";
+        if (severity == "warning") {
+            level = "warning";
+        }
+        else if (severity == "critical") {
+            level = "danger";
+        }
+
+        $('<div class="alert" role="alert"></div>').addClass("alert-" + level).text(message).appendTo('#tryit_announcements');
+    }
 
     function getUrlParameter(sParam) {
         var sPageURL = decodeURIComponent(window.location.search.substring(1)),
@@ -68,7 +82,30 @@ $(document).ready(function() {
         var timeinterval = setInterval(updateClock, 1000);
     }
 
+    function setupEvents(id) {
+        if (events) {
+            return;
+        }
+
+        events = new WebSocket(tryit_server_websocket + "/1.0/events?id=" + id);
+        events.onmessage = function(msg) {
+            var event = JSON.parse(msg.data);
+            if (event.type == "expiry-warning") {
+                showAnnouncement("warning", event.metadata.message);
+            }
+            else if (event.type == "session-ended") {
+                window.location.href = original_url;
+            }
+        };
+
+        events.onclose = function(msg) {
+            events = null;
+        };
+    }
+
     function setupConsole(id) {
+        setupEvents(id);
+
         term = new Terminal({fontSize: 12});
         fitAddon = new FitAddon.FitAddon();
         term.loadAddon(fitAddon);
@@ -77,19 +114,32 @@ $(document).ready(function() {
 
         var height = term.rows;
         var width = term.cols;
-        sock = new WebSocket(tryit_server_websocket + "/1.0/console?id=" + id + "&width=" + width + "&height=" + height);
+        var terminal = Math.random().toString(36).substring(2);
+        sock = new WebSocket(tryit_server_websocket + "/1.0/console?id=" + id + "&width=" + width + "&height=" + height + "&terminal=" + terminal);
         sock.onopen = function (e) {
             attachAddon = new AttachAddon.AttachAddon(sock);
             term.loadAddon(attachAddon);
             $('#tryit_console_reconnect').css("display", "none");
 
+            term.onResize(function(size) {
+                $.ajax({url: tryit_server_rest + "/1.0/console/resize?id=" + id + "&terminal=" + terminal + "&width=" + size.cols + "&height=" + size.rows,
+                        type: "POST"});
+            });
+
             sock.onclose = function(msg) {
                 term.dispose();
+                fitAddon = null;
                 $('#tryit_console_reconnect').css("display", "inherit");
             };
         };
     }
 
+    $(window).resize(function() {
+        if (fitAddon != null) {
+            fitAddon.fit();
+        }
+    });
+
     function getSize(element, cell) {
         var wSubs   = element.offsetWidth - element.clientWidth,
             w       = element.clientWidth - wSubs,
@@ -161,7 +211,20 @@ $(document).ready(function() {
                     $('#tryit_ssh_row').css("display", "none");
                 }
 
-                if (data.server_status == 1) {
+                $.each(data.announcements || [], function(i, entry) {
+                    showAnnouncement(entry.severity, entry.message);
+                });
+
+                if (data.maintenance_next) {
+                    var notice = "Scheduled maintenance from " + new Date(data.maintenance_next.start * 1000).toLocaleString() + " to " + new Date(data.maintenance_next.end * 1000).toLocaleString() + ".";
+                    if (data.maintenance_next.message != "") {
+                        notice += " " + data.maintenance_next.message;
+                    }
+
+                    showAnnouncement("warning", notice);
+                }
+
+                if (data.server_status != 0) {
                     $('#tryit_maintenance_message').css("display", "inherit");
                     if (data.server_message != "") {
                         $('#tryit_maintenance_message').text(data.server_message);
@@ -257,8 +320,14 @@ $(document).ready(function() {
 
         var last_response_len = false;
         var last_response = "";
+        var start_url = tryit_server_rest + "/1.0/start?terms=" + tryit_terms_hash;
+        var scenario = getUrlParameter("scenario");
+        if (scenario != "") {
+            start_url += "&scenario=" + encodeURIComponent(scenario);
+        }
+
         $.ajax({
-            url: tryit_server_rest + "/1.0/start?terms=" + tryit_terms_hash,
+            url: start_url,
             xhrFields: {
               onprogress: function(e) {
                 var this_response, response = e.currentTarget.response;
@@ -302,6 +371,12 @@ $(document).ready(function() {
                 else if (data.status == 5) {
                     $('#tryit_error_unknown').css("display", "inherit");
                 }
+                else if (data.status == 6) {
+                    $('#tryit_error_draining').css("display", "inherit");
+                }
+                else if (data.status == 7) {
+                    $('#tryit_error_maintenance').css("display", "inherit");
+                }
                 $('#tryit_error_panel_create').css("display", "inherit");
                 $('#tryit_error_panel').css("display", "inherit");
                 return